@@ -0,0 +1,223 @@
+package airfoilgo
+
+import (
+	"strings"
+	"time"
+)
+
+const EventActiveSourceChanged EventType = "activeSourceChanged"
+
+// who changed the active source
+const (
+	ChangedByLocal  = "local"  //selected through this connection
+	ChangedByRemote = "remote" //another remote, or airfoil itself
+	ChangedByStore  = "store"  //restored from the store on startup
+)
+
+// a selectSource of ours explains a change of the active source for this long
+var selectWindow = 10 * time.Second
+
+// ActiveSourceChange is the data of an EventActiveSourceChanged
+type ActiveSourceChange struct {
+	Source    Source    `json:"source"`
+	Previous  Source    `json:"previous"`
+	ChangedAt time.Time `json:"changedAt"`
+	ChangedBy string    `json:"changedBy"`
+}
+
+type pendingSelect struct {
+	ident string
+	at    time.Time
+}
+
+// ActiveSourceChange tells when and by whom the active source was last changed
+func (a *AirfoilConn) ActiveSourceChange() ActiveSourceChange {
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	return a.activeChange
+
+}
+
+// markSelecting remembers a selectSource we sent, so the change it causes is attributed to us
+func (a *AirfoilConn) markSelecting(ident string) {
+
+	a.sourceLock.Lock()
+	a.selecting = pendingSelect{ident: ident, at: time.Now()}
+	a.sourceLock.Unlock()
+
+}
+
+// selectReplied handles airfoil's reply to our selectSource, the source is active from here on
+// even if the metadata that follows names it differently
+func (a *AirfoilConn) selectReplied(response AirfoilResponse) {
+
+	a.sourceLock.Lock()
+	sel := a.selecting
+	src, ok := a.sources[sel.ident]
+	a.sourceLock.Unlock()
+
+	if sel.ident == "" || time.Since(sel.at) > selectWindow {
+		return
+	}
+
+	if response.Data.Success != nil && !*response.Data.Success {
+
+		a.sourceLock.Lock()
+		a.selecting = pendingSelect{}
+		a.sourceLock.Unlock()
+
+		a.logf("selectSource %s refused by airfoil\n", sel.ident)
+		return
+
+	}
+
+	if ok {
+		a.setActiveSource(src, ChangedByLocal)
+	}
+
+	//the reply says nothing about what is playing now
+	a.FetchMetadata()
+
+}
+
+// metadataReplied works out the active source from a getSourceMetadata reply, the name in the
+// metadata is only a last resort since several sources can share it
+func (a *AirfoilConn) metadataReplied(md RequestedData) {
+
+	sn, _ := md.SourceName.(string)
+	bid, _ := md.Bundleid.(string)
+
+	if sn == "" && bid == "" {
+		return
+	}
+
+	src, byName := a.activeFromMetadata(sn, strings.ToLower(bid))
+
+	if src.Identifier == "" {
+
+		//the source list isn't loaded yet or doesn't have it, keep the name until it is.
+		//only once per name, some sources never show up in the list
+		if a.ActiveSource().FriendlyName != sn {
+			a.FetchSources()
+		}
+
+	} else if byName && bid != "" {
+		a.learnBundle(bid, src.Identifier)
+	}
+
+	by := ChangedByRemote
+
+	a.sourceLock.RLock()
+	sel := a.selecting
+	a.sourceLock.RUnlock()
+
+	if sel.ident != "" && sel.ident == src.Identifier && time.Since(sel.at) <= selectWindow {
+		by = ChangedByLocal
+	}
+
+	a.setActiveSource(src, by)
+
+}
+
+func (a *AirfoilConn) activeFromMetadata(sn string, bid string) (Source, bool) {
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	if bid != "" {
+
+		if src, ok := a.sources[a.bundles[bid]]; ok {
+			return src, false
+		}
+
+		for _, src := range a.sources {
+
+			if strings.ToLower(src.Identifier) == bid {
+				return src, false
+			}
+
+		}
+
+	}
+
+	//what we just selected, airfoil may still be switching over
+	if src, ok := a.sources[a.selecting.ident]; ok && time.Since(a.selecting.at) <= selectWindow {
+
+		if sn == "" || src.FriendlyName == sn {
+			return src, true
+		}
+
+	}
+
+	if sn == "" {
+		return a.activeChange.Source, false
+	}
+
+	//duplicate names, nothing says it moved
+	if a.activeChange.Source.Identifier != "" && a.activeChange.Source.FriendlyName == sn {
+		return a.activeChange.Source, true
+	}
+
+	var matches []Source
+
+	for _, src := range a.catalog.All() {
+
+		if src.FriendlyName == sn {
+			matches = append(matches, src)
+		}
+
+	}
+
+	if len(matches) == 0 {
+		return Source{FriendlyName: sn}, false
+	}
+
+	//a running app is the likelier one to be playing
+	for _, src := range matches {
+
+		if src.Running {
+			return src, true
+		}
+
+	}
+
+	return matches[0], true
+
+}
+
+// SetActiveSource records src as active, as if this connection had selected it
+func (a *AirfoilConn) SetActiveSource(src Source) {
+	a.setActiveSource(src, ChangedByLocal)
+}
+
+func (a *AirfoilConn) setActiveSource(src Source, by string) {
+
+	a.sourceLock.Lock()
+
+	prev := a.activeChange.Source
+	changed := prev.Identifier != src.Identifier || prev.FriendlyName != src.FriendlyName
+
+	if changed {
+		a.activeChange = ActiveSourceChange{Source: src, Previous: prev, ChangedAt: time.Now(), ChangedBy: by}
+	} else {
+		//fresher icon or running flag, same source
+		a.activeChange.Source = src
+	}
+
+	if a.selecting.ident == src.Identifier || time.Since(a.selecting.at) > selectWindow {
+		a.selecting = pendingSelect{}
+	}
+
+	change := a.activeChange
+
+	a.sourceLock.Unlock()
+
+	if changed {
+		a.bump()
+		a.persist()
+		a.emit(Event{Type: EventActiveSourceChanged, Source: src.Identifier, Data: change})
+	}
+
+}
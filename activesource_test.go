@@ -0,0 +1,187 @@
+package airfoilgo
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// sourcesLoaded is pipeConn with the fixture source list applied
+func sourcesLoaded(t *testing.T) (*AirfoilConn, net.Conn, <-chan map[string]interface{}) {
+
+	t.Helper()
+
+	a, remote, sent := pipeConn(t)
+
+	notify(t, remote, `{"replyID":"9","data":`+string(readFixture(t, "getSourceList.json"))+`}`)
+
+	deadline := time.Now().Add(time.Second)
+
+	for len(a.Catalog().All()) == 0 {
+
+		if time.Now().After(deadline) {
+			t.Fatal("the source list was never applied")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+	}
+
+	return a, remote, sent
+
+}
+
+// waitActive waits for ident to become the active source and returns the change
+func waitActive(t *testing.T, a *AirfoilConn, ident string) ActiveSourceChange {
+
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+
+		change := a.ActiveSourceChange()
+
+		if change.Source.Identifier == ident {
+			return change
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("active source is %+v, want %s", change.Source, ident)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+	}
+
+}
+
+// expectRequest skips over polls until the named request is written
+func expectRequest(t *testing.T, sent <-chan map[string]interface{}, name string) map[string]interface{} {
+
+	t.Helper()
+
+	for {
+
+		if req := nextRequest(t, sent); req["request"] == name {
+			return req
+		}
+
+	}
+
+}
+
+func TestActiveSourceSelectedLocally(t *testing.T) {
+
+	a, remote, sent := sourcesLoaded(t)
+
+	if err := a.SetSource("com.spotify.client"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRequest(t, sent, "selectSource")
+
+	//airfoil announces the switch before it replies to the select
+	notify(t, remote, `{"replyID":"13","data":{"metadata":{"sourceName":"Spotify","bundleid":"com.spotify.client"}}}`)
+
+	change := waitActive(t, a, "com.spotify.client")
+
+	if change.ChangedBy != ChangedByLocal {
+		t.Fatalf("our own select was put down to %s", change.ChangedBy)
+	}
+
+	//the select is settled, the reply that follows changes nothing
+	notify(t, remote, `{"replyID":"15","data":{"success":true}}`)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if got := a.ActiveSourceChange(); got.ChangedAt != change.ChangedAt || got.ChangedBy != ChangedByLocal {
+		t.Fatalf("the select reply moved the change to %+v", got)
+	}
+
+}
+
+func TestActiveSourceSelectReply(t *testing.T) {
+
+	a, remote, sent := sourcesLoaded(t)
+
+	if err := a.SetSource("/Applications/Music.app"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRequest(t, sent, "selectSource")
+
+	notify(t, remote, `{"replyID":"15","data":{"success":true}}`)
+
+	if change := waitActive(t, a, "/Applications/Music.app"); change.ChangedBy != ChangedByLocal {
+		t.Fatalf("the select reply was put down to %s", change.ChangedBy)
+	}
+
+	//the reply says nothing about what is playing, so the metadata is fetched
+	expectRequest(t, sent, "getSourceMetadata")
+
+	//airfoil reports the app by bundle id, which the name lookup learns
+	notify(t, remote, `{"replyID":"13","data":{"metadata":{"sourceName":"Music","bundleid":"com.apple.Music"}}}`)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if change := a.ActiveSourceChange(); change.Source.Identifier != "/Applications/Music.app" || change.ChangedBy != ChangedByLocal {
+		t.Fatalf("the metadata after our select gave %+v", change)
+	}
+
+	a.sourceLock.RLock()
+	learnt := a.bundles["com.apple.music"]
+	a.sourceLock.RUnlock()
+
+	if learnt != "/Applications/Music.app" {
+		t.Fatalf("com.apple.Music was learnt as %q", learnt)
+	}
+
+}
+
+func TestActiveSourceChangedRemotely(t *testing.T) {
+
+	a, remote, _ := sourcesLoaded(t)
+
+	notify(t, remote, `{"replyID":"13","data":{"metadata":{"sourceName":"Safari","bundleid":"com.apple.Safari"}}}`)
+
+	change := waitActive(t, a, "com.apple.Safari")
+
+	if change.ChangedBy != ChangedByRemote {
+		t.Fatalf("a change nobody here asked for was put down to %s", change.ChangedBy)
+	}
+
+	if change.Previous.Identifier != "" {
+		t.Fatalf("previous source %+v", change.Previous)
+	}
+
+}
+
+func TestActiveSourceSelectRefused(t *testing.T) {
+
+	a, remote, sent := sourcesLoaded(t)
+
+	if err := a.SetSource("com.spotify.client"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRequest(t, sent, "selectSource")
+
+	notify(t, remote, `{"replyID":"15","data":{"success":false}}`)
+
+	//someone else then picks the source we asked for, the refused select doesn't claim it
+	notify(t, remote, `{"replyID":"13","data":{"metadata":{"sourceName":"Spotify","bundleid":"com.spotify.client"}}}`)
+
+	if change := waitActive(t, a, "com.spotify.client"); change.ChangedBy != ChangedByRemote {
+		t.Fatalf("a refused select was still put down to %s", change.ChangedBy)
+	}
+
+	a.sourceLock.RLock()
+	sel := a.selecting
+	a.sourceLock.RUnlock()
+
+	if sel.ident != "" {
+		t.Fatalf("still selecting %s", sel.ident)
+	}
+
+}
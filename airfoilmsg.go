@@ -1,5 +1,7 @@
 package airfoilgo
 
+import "encoding/json"
+
 /*
 Reference requests in json
 
@@ -45,9 +47,11 @@ Reference requests in json
 	}
 */
 type AirfoilResponse struct {
-	ReplyID string       `json:"replyID"`
-	Data    DataResponse `json:"data"`
-	Request string       `json:"request"`
+	ReplyID string          `json:"replyID"`
+	Data    DataResponse    `json:"data"`
+	Request string          `json:"request"`
+	Raw     json.RawMessage `json:"-"`
+	Catalog *SourceCatalog  `json:"-"` //set on getSourceList replies
 }
 
 type DataResponse struct {
@@ -57,9 +61,11 @@ type DataResponse struct {
 	CanConnect       bool          `json:"canConnect"`
 	Notifications    []string      `json:"notifications"`
 	LongIdentifier   string        `json:"longIdentifier"`
+	Name             string        `json:"name,omitempty"`
 	Connected        bool          `json:"connected,omitempty"`
 	Volume           float64       `json:"volume,omitempty"`
 	Metadata         RequestedData `json:"metadata,omitempty"`
+	Success          *bool         `json:"success,omitempty"`
 }
 
 type Speaker struct {
@@ -69,6 +75,7 @@ type Speaker struct {
 	Name           string  `json:"name"`
 	Type           string  `json:"type"`
 	Connected      bool    `json:"connected"`
+	Stale          bool    `json:"stale,omitempty"`
 }
 
 type SourceResponse struct {
@@ -81,6 +88,8 @@ type Source struct {
 	Icon         string `json:"icon"`
 	Identifier   string `json:"identifier"`
 	Type         string `json:"type"`
+	Running      bool   `json:"running,omitempty"`
+	Stale        bool   `json:"stale,omitempty"`
 }
 
 type AirfoilRequest struct {
@@ -95,8 +104,9 @@ type DataRequest struct {
 	LongIdentifier string        `json:"longIdentifier,omitempty"`
 	ScaleFactor    int           `json:"scaleFactor,omitempty"`
 	IconSize       int           `json:"iconSize,omitempty"`
-	Volume         float64       `json:"volume,omitempty"`
+	Volume         *float64      `json:"volume,omitempty"` //a pointer so 0 is still sent
 	RequestedData  RequestedData `json:"requestedData,omitempty"`
+	Notifications  []string      `json:"notifications,omitempty"`
 }
 
 type RequestedData struct {
@@ -6,12 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/grandcat/zeroconf"
+	"io"
 	"log"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,33 +23,122 @@ const OK_REGEXP = "^OK\n$"
 
 //unimplemented requests
 
-var versioncheck *regexp.Regexp
-var okcheck *regexp.Regexp
+var versioncheck = regexp.MustCompile(PROTOCOL_REGEXP)
+var okcheck = regexp.MustCompile(OK_REGEXP)
+var framecheck = regexp.MustCompile("[0-9]+;")
 var readlen = 1024
 var maxbuffer = 16384
+var maxErrors = 20
 var Airfoils []string
 
 type AirfoilConn struct {
-	Status           int
+	version          uint64 //first so it stays 64 bit aligned for atomic on 32 bit platforms
+	lastFrame        int64  //unix nanos, next to version for the same reason
+	state            int32
+	subscribed       int32
 	Address          string
 	Conn             net.Conn
 	Cb               func(AirfoilResponse, error)
-	Speakers         map[string]Speaker
-	Sources          map[string]Source
-	ActiveSourceKey  string
-	ActiveSourceName string
-	SpeakerLock      sync.RWMutex
-	SourceLock       sync.RWMutex
+	speakers         map[string]Speaker
+	sources          map[string]Source
+	catalog          SourceCatalog
+	activeChange     ActiveSourceChange
+	selecting        pendingSelect
+	nowPlaying       NowPlaying
+	speakerLock      sync.RWMutex
+	sourceLock       sync.RWMutex
 	Errors           []error
+	Notifications    []string
+	DialTimeout      time.Duration
+	WriteTimeout     time.Duration
+	ReadTimeout      time.Duration
+	Dialer           *net.Dialer
+	DialFunc         func(ctx context.Context, network string, addr string) (net.Conn, error)
+	Logger           *log.Logger
+	SourceIconSize   int
+	SourceScale      int
+	MetadataScale    int
+	MetadataFields   RequestedData
+	Reconnect        ReconnectPolicy
+	QueueSize        int
+	DispatchMode     DispatchMode
+	DispatchWorkers  int
+	DispatchQueue    int
+	CallbackQueue    int
+	SlowCallback     time.Duration
+	HeartbeatEvery   time.Duration
+	HeartbeatTimeout time.Duration
+	metrics          *Metrics
+	nicknames        map[string]string
+	aliases          map[string]string
+	sourceAliases    map[string]string
+	bundles          map[string]string
+	volumes          map[string]float64
+	renamed          map[string]string //old long identifier to the one airfoil reissued it as
+	store            Store
+	storePending     bool
+	storeLock        sync.Mutex
+	listeners        map[int]func(Event)
+	listenerSeq      int
+	listenerLock     sync.RWMutex
+	eventQueue       []func()
+	eventLock        sync.Mutex
+	eventReady       chan struct{}
+	eventOnce        sync.Once
+	pending          map[string]chan requestReply
+	requestSeq       int
+	pendingLock      sync.Mutex
+	queue            *writeQueue
+	connLock         sync.Mutex
+	errLock          sync.Mutex
+	shards           []chan frame
+	callbacks        chan func()
+	dispatchOnce     sync.Once
+	heartbeat        HeartbeatStatus
+	heartbeatLock    sync.RWMutex
+	HistorySize      int       //how many entries History keeps, 0 keeps none
+	HistoryLog       io.Writer //every entry is also written here as a json line when set
+	history          []HistoryEntry
+	historyNext      int
+	historyLock      sync.Mutex
+	historyLines     chan []byte
+	historyOnce      sync.Once
 }
 
-func NewConn(addr string) *AirfoilConn {
-	versioncheck, _ = regexp.Compile(PROTOCOL_REGEXP)
-	okcheck, _ = regexp.Compile(OK_REGEXP)
+func NewConn(addr string, opts ...Option) *AirfoilConn {
 	conn := &AirfoilConn{}
-	conn.Speakers = make(map[string]Speaker)
-	conn.Sources = make(map[string]Source)
+	conn.speakers = make(map[string]Speaker)
+	conn.sources = make(map[string]Source)
+	conn.metrics = NewMetrics()
+	conn.nicknames = make(map[string]string)
+	conn.aliases = make(map[string]string)
+	conn.sourceAliases = make(map[string]string)
+	conn.bundles = make(map[string]string)
+	conn.volumes = make(map[string]float64)
+	conn.renamed = make(map[string]string)
+	conn.Notifications = append([]string(nil), DefaultNotifications...)
+	conn.DialTimeout = 5 * time.Second
+	conn.WriteTimeout = 2 * time.Second
+	conn.SourceIconSize = 16
+	conn.SourceScale = 1
+	conn.MetadataScale = 2
+	conn.MetadataFields = DefaultMetadataFields
+	conn.Reconnect = DefaultReconnectPolicy
+	conn.QueueSize = 64
+	conn.DispatchMode = DispatchOrdered
+	conn.DispatchWorkers = 4
+	conn.DispatchQueue = 256
+	conn.CallbackQueue = 256
+	conn.SlowCallback = time.Second
+	conn.HeartbeatEvery = 10 * time.Second
+	conn.HeartbeatTimeout = 5 * time.Second
+	conn.HistorySize = 1000
 	conn.Address = addr
+
+	for _, opt := range opts {
+		opt(conn)
+	}
+
 	return conn
 }
 
@@ -97,72 +188,51 @@ func (a *AirfoilConn) Reader(cb func(AirfoilResponse, error)) {
 
 func (a *AirfoilConn) Send(msg string) error {
 
-	if a.Status > 2 {
+	return a.SendPriority(msg, PriorityNormal)
+
+}
+
+// SendPriority queues msg for the writer, higher priorities jump ahead of what is already waiting
+func (a *AirfoilConn) SendPriority(msg string, p Priority) error {
 
-		return a.send(msg)
+	if a.status() == StateReady {
+
+		return a.send(msg, p, "")
 	}
 
-	return errors.New("Connection Status Not Ready")
+	return ErrNotReady
 }
 
-func (a *AirfoilConn) send(msg string) error {
+func (a *AirfoilConn) send(msg string, p Priority, key string) error {
 
-	a.Conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
 	ml := len(msg)
 	payload := fmt.Sprintf("%d;%s", ml, msg)
-	log.Printf("Sending Request:%s\n", payload)
-	_, werr := a.Conn.Write([]byte(payload))
-	if werr != nil {
-		return werr
-	}
+	a.logf("Sending Request:%s\n", payload)
 
-	return nil
+	return a.enqueue(payload, p, key)
 }
 
 func (a *AirfoilConn) Close() error {
 
-	if a.Conn != nil {
-		//close if an existing connection
-
-		return a.Conn.Close()
+	a.connLock.Lock()
+	q := a.queue
+	a.queue = nil
+	a.connLock.Unlock()
 
+	if q != nil {
+		q.close(ErrConnClosed)
 	}
 
-	return nil
+	a.failPending(ErrConnClosed)
 
-}
-
-func (a *AirfoilConn) KeepAlive() {
-
-	tick := time.NewTicker(time.Second * 10)
-
-	for range tick.C {
-
-		stat := a.Ping()
-
-		if stat != nil {
-
-			res, _ := Scan()
-
-			if len(res) > 0 {
-				a.Address = res[0]
-			}
-
-			a.Status = 0 //reset and redial!
+	if a.Conn != nil {
+		//close if an existing connection
 
-			a.Dial()
-		}
+		return a.Conn.Close()
 
 	}
 
-}
-
-func (a *AirfoilConn) Ping() error {
-
-	d := net.Dialer{Timeout: time.Second * 5}
-	_, err := d.Dial("tcp", a.Address)
-
-	return err
+	return nil
 
 }
 
@@ -170,18 +240,36 @@ func (a *AirfoilConn) Dial() error {
 
 	var err error
 
-	a.Status = 1
+	a.setStatus(StateDialing)
 
 	a.Close() //close existing
 
-	d := net.Dialer{Timeout: time.Second * 5}
-	a.Conn, err = d.Dial("tcp", a.Address)
+	ctx, cancel := context.WithTimeout(context.Background(), a.DialTimeout)
+	defer cancel()
+
+	if a.DialFunc != nil {
+		a.Conn, err = a.DialFunc(ctx, "tcp", a.Address)
+	} else if a.Dialer != nil {
+		a.Conn, err = a.Dialer.DialContext(ctx, "tcp", a.Address)
+	} else {
+		d := net.Dialer{}
+		a.Conn, err = d.DialContext(ctx, "tcp", a.Address)
+	}
 
 	if err != nil {
 
 		return err
 	}
 
+	q := newWriteQueue(a.QueueSize)
+
+	a.connLock.Lock()
+	a.queue = q
+	a.connLock.Unlock()
+
+	a.dispatchOnce.Do(a.startDispatch)
+
+	go a.writeLoop(a.Conn, q)
 	go a.handleRequest()
 
 	return nil
@@ -192,16 +280,25 @@ func (a *AirfoilConn) handleRequest() {
 	// Buffer that holds incoming information
 	buf := make([]byte, readlen)
 
-	re := regexp.MustCompile("[0-9]+;")
+	a.connLock.Lock()
+	q := a.queue
+	a.connLock.Unlock()
 
 	for {
+		if a.ReadTimeout > 0 {
+			a.Conn.SetReadDeadline(time.Now().Add(a.ReadTimeout))
+		}
+
 		rlen, err := a.Conn.Read(buf)
 
 		if err != nil {
-			fmt.Println("Read Error:", err.Error())
+			a.logf("Read Error: %s\n", err)
+			a.connLost(q)
 			return //close it down
 		}
 
+		atomic.StoreInt64(&a.lastFrame, time.Now().UnixNano())
+
 		s := string(buf[:rlen])
 
 		//was there a starting stanza?
@@ -224,7 +321,8 @@ func (a *AirfoilConn) handleRequest() {
 						len2, err2 := a.Conn.Read(buf2)
 
 						if err2 != nil {
-							fmt.Println("Read Error:", err2.Error())
+							a.logf("Read Error: %s\n", err2)
+							a.connLost(q)
 							return //close it down
 						}
 
@@ -239,61 +337,56 @@ func (a *AirfoilConn) handleRequest() {
 
 		}
 
-		log.Printf("Raw String Response: %s\n", s)
+		a.logf("Raw String Response: %s\n", s)
 
 		//dont pass up to client til handshake done
-		if a.Status > 2 {
+		if a.status() == StateReady {
 
 			//we may have gotten multiple segments in one string, so break it up
 
-			split := re.Split(s, -1)
+			split := framecheck.Split(s, -1)
 
 			for i := range split {
 
 				if len(split[i]) > 0 {
 					//because we are handling json with a leading bit of data and we have to split on it to detect, lets put something back
 
-					go func(sp string) {
-						resp, serr := a.parse(fmt.Sprintf("%d;%s", len(sp), sp))
-
-						a.intercept(resp, serr)
+					resp, serr := a.parse(fmt.Sprintf("%d;%s", len(split[i]), split[i]))
 
-						a.Cb(resp, serr)
-					}(split[i])
+					a.dispatch(resp, serr)
 				}
 
 			}
 
 		}
 
-		if a.Status < 2 && versioncheck.MatchString(s) {
+		if a.status() < StateHandshake && versioncheck.MatchString(s) {
 
 			///log.Println("Got Protocol Request")
 
-			_, cerr := a.Conn.Write([]byte(PROTOCOL_VERSION))
+			cerr := a.enqueue(PROTOCOL_VERSION, PriorityHigh, "")
 
 			if cerr != nil {
-				log.Println(err)
+				a.logf("Protocol Error: %s\n", cerr)
 			}
 
-			a.Status = 2
+			a.setStatus(StateHandshake)
 
 			time.Sleep(500 * time.Millisecond)
 		}
 
-		if a.Status == 2 && okcheck.MatchString(s) {
+		if a.status() == StateHandshake && okcheck.MatchString(s) {
 
 			//log.Println("Got Ok")
 
-			_, werr := a.Conn.Write([]byte("OK\n"))
+			werr := a.enqueue("OK\n", PriorityHigh, "")
 
 			if werr == nil {
 
-				a.Status = 3
-				subscribe := `{"request":"subscribe","requestID":"3","data":{"notifications":["remoteControlChangedRequest","speakerConnectedChanged","speakerListChanged","speakerNameChanged","speakerPasswordChanged","speakerVolumeChanged"]}}`
-				werr2 := a.Send(subscribe)
+				a.setStatus(StateReady)
+				werr2 := a.sendSubscribe()
 				if werr2 != nil {
-					log.Println("Subscribed!")
+					a.logf("Subscribe Error: %s\n", werr2)
 				}
 			}
 
@@ -306,28 +399,39 @@ func (a *AirfoilConn) handleRequest() {
 // handle syncing states  to the speaker struct
 func (a *AirfoilConn) intercept(response AirfoilResponse, err error) {
 
+	a.resolvePending(response)
+	a.recordNotification(response)
+
+	if response.ReplyID == "3" {
+		atomic.StoreInt32(&a.subscribed, 1)
+	}
+
 	if response.Request == "speakerListChanged" || response.ReplyID == "3" {
 
-		for _, sp := range response.Data.Speakers {
-			//updating speaker struct
-			a.SetSpeaker(&sp)
-		}
+		//the list is complete, so anything missing from it is gone
+		a.applySpeakerList(response.Data.Speakers)
+		a.persist()
 
 	}
 	//handle sources
 	if response.ReplyID == "9" {
 
-		a.SourceLock.Lock()
-		for _, sc := range response.Data.Sources {
-			a.Sources[sc.Identifier] = sc
+		if response.Catalog != nil {
+			a.applyCatalog(*response.Catalog)
 		}
-		a.SourceLock.Unlock()
 
 	}
 
+	if response.ReplyID == "15" {
+		a.selectReplied(response)
+	}
+
 	if response.ReplyID == "13" {
-		sn := response.Data.Metadata.SourceName.(string)
-		a.SetActiveSource(a.GetSourceByName(sn))
+
+		a.metadataReplied(response.Data.Metadata)
+
+		//after the active source, so anyone woken by the event sees both
+		a.setNowPlaying(response.Data.Metadata)
 	}
 	//we receive no data other than an alert so we'll fetch the metadata here
 	if response.Request == "sourceMetadataChanged" {
@@ -339,22 +443,33 @@ func (a *AirfoilConn) intercept(response AirfoilResponse, err error) {
 
 	if response.Request == "speakerConnectedChanged" {
 
-		spk, err := a.GetSpeaker(response.Data.LongIdentifier)
-
-		if err == nil {
+		spk, ok := a.updateSpeaker(response.Data.LongIdentifier, func(spk *Speaker) {
 			spk.Connected = response.Data.Connected
-			a.SetSpeaker(spk)
+		})
+
+		if ok {
+			a.persist()
+			a.emit(Event{Type: EventSpeakerChanged, Speaker: spk.LongIdentifier, Data: spk})
 		}
 
 	}
 
-	if response.Request == "speakerVolumeChanged" {
+	if response.Request == "speakerNameChanged" {
+
+		a.renameSpeaker(response.Data.LongIdentifier, response.Data.Name)
+		a.persist()
+
+	}
 
-		spk, err := a.GetSpeaker(response.Data.LongIdentifier)
+	if response.Request == "speakerVolumeChanged" {
 
-		if err == nil {
+		spk, ok := a.updateSpeaker(response.Data.LongIdentifier, func(spk *Speaker) {
 			spk.Volume = response.Data.Volume
-			a.SetSpeaker(spk)
+		})
+
+		if ok {
+			a.persist()
+			a.emit(Event{Type: EventSpeakerChanged, Speaker: spk.LongIdentifier, Data: spk})
 		}
 
 	}
@@ -363,15 +478,14 @@ func (a *AirfoilConn) intercept(response AirfoilResponse, err error) {
 
 func (a *AirfoilConn) Subscribe() error {
 
-	a.Status = 3
-	subscribe := `{"request":"subscribe","requestID":"3","data":{"notifications":["remoteControlChangedRequest","speakerConnectedChanged","speakerListChanged","speakerNameChanged","speakerPasswordChanged","speakerVolumeChanged"]}}`
-	return a.Send(subscribe)
+	a.setStatus(StateReady)
+	return a.sendSubscribe()
 
 }
 
 func (a *AirfoilConn) parse(resp string) (AirfoilResponse, error) {
 
-	log.Printf("String to Parse: %s\n", resp)
+	a.logf("String to Parse: %s\n", resp)
 
 	parts := strings.Split(resp, ";")
 
@@ -383,37 +497,36 @@ func (a *AirfoilConn) parse(resp string) (AirfoilResponse, error) {
 		if msglen == len(parts[1]) {
 			//got some json decode!
 
+			di.Raw = json.RawMessage(parts[1])
+
 			e := json.Unmarshal([]byte(parts[1]), &di)
 
 			if e != nil {
+				//data we don't model, keep the envelope so a Request can still get its reply
+				var env struct {
+					ReplyID string `json:"replyID"`
+					Request string `json:"request"`
+				}
+				json.Unmarshal([]byte(parts[1]), &env)
+				di.ReplyID = env.ReplyID
+				di.Request = env.Request
 				return di, e
 			}
 
-			if di.ReplyID == "3" {
+			if di.ReplyID == "9" { //this is a source response
 
-				for _, s := range di.Data.Speakers {
-
-					a.SetSpeaker(&s)
+				var sr struct {
+					Data json.RawMessage `json:"data"`
 				}
-
-			} else if di.ReplyID == "9" { //this is a source response
-
-				var sr SourceResponse
 				e2 := json.Unmarshal([]byte(parts[1]), &sr)
 
-				var out []Source
 				if e2 == nil {
 
-					for typ, items := range sr.Data {
-
-						for _, it := range items {
-							it.Type = typ
-
-							out = append(out, it)
-
-						}
+					if cat, e3 := DecodeSourceCatalog(sr.Data); e3 == nil {
+						di.Catalog = &cat
+						di.Data.Sources = cat.All()
 					}
-					di.Data.Sources = out
+
 				}
 
 			}
@@ -433,15 +546,7 @@ func (a *AirfoilConn) Connect(id string) error {
 
 	req := AirfoilRequest{Request: "connectToSpeaker", RequestID: "5", Data: DataRequest{LongIdentifier: id}}
 
-	outb, err := json.Marshal(req)
-
-	if err != nil {
-
-		return err
-
-	}
-
-	return a.Send(string(outb))
+	return a.sendRequest(req, PriorityHigh)
 
 }
 
@@ -449,9 +554,9 @@ func (a *AirfoilConn) GetSourceByName(friendly_name string) Source {
 
 	var ret Source
 
-	a.SourceLock.RLock()
-	defer a.SourceLock.RUnlock()
-	for _, sc := range a.Sources {
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+	for _, sc := range a.sources {
 		if friendly_name == sc.FriendlyName {
 			return sc
 		}
@@ -461,25 +566,21 @@ func (a *AirfoilConn) GetSourceByName(friendly_name string) Source {
 
 func (a *AirfoilConn) Volume(id string, vol float64) error {
 
-	req := AirfoilRequest{Request: "setSpeakerVolume", RequestID: "10", Data: DataRequest{LongIdentifier: id, Volume: vol}}
-
-	outb, err := json.Marshal(req)
-
-	if err != nil {
-
-		return err
-
-	}
+	req := AirfoilRequest{Request: "setSpeakerVolume", RequestID: "10", Data: DataRequest{LongIdentifier: id, Volume: &vol}}
 
-	return a.Send(string(outb))
+	return a.sendRequest(req, PriorityHigh)
 
 }
 
 func (a *AirfoilConn) SetSpeaker(spkr *Speaker) error {
 
-	a.SpeakerLock.Lock()
-	a.Speakers[spkr.LongIdentifier] = *spkr
-	a.SpeakerLock.Unlock()
+	a.speakerLock.Lock()
+	a.speakers[spkr.LongIdentifier] = *spkr
+	if !spkr.Stale && spkr.Volume > 0 {
+		a.volumes[spkr.LongIdentifier] = spkr.Volume
+	}
+	a.speakerLock.Unlock()
+	a.bump()
 	return nil
 
 }
@@ -487,9 +588,9 @@ func (a *AirfoilConn) SetSpeaker(spkr *Speaker) error {
 func (a *AirfoilConn) GetSpeaker(id string) (*Speaker, error) {
 
 	var sd *Speaker
-	a.SpeakerLock.RLock()
-	defer a.SpeakerLock.RUnlock()
-	for _, s := range a.Speakers {
+	a.speakerLock.RLock()
+	defer a.speakerLock.RUnlock()
+	for _, s := range a.speakers {
 
 		if id == s.LongIdentifier {
 
@@ -498,16 +599,16 @@ func (a *AirfoilConn) GetSpeaker(id string) (*Speaker, error) {
 
 	}
 
-	return sd, errors.New("NOT_FOUND")
+	return sd, ErrNotFound
 
 }
 
 func (a *AirfoilConn) GetSource(id string) (*Source, error) {
 
 	var sd *Source
-	a.SourceLock.RLock()
-	defer a.SourceLock.RUnlock()
-	for _, s := range a.Sources {
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+	for _, s := range a.sources {
 
 		if id == s.Identifier {
 
@@ -516,46 +617,23 @@ func (a *AirfoilConn) GetSource(id string) (*Source, error) {
 
 	}
 
-	return sd, errors.New("NOT_FOUND")
-
-}
-
-func (a *AirfoilConn) SetActiveSource(src Source) {
-
-	a.ActiveSourceName = src.FriendlyName
-	a.ActiveSourceKey = src.Identifier
+	return sd, ErrNotFound
 
 }
 
 func (a *AirfoilConn) FetchSources() error {
 
-	req := AirfoilRequest{Request: "getSourceList", RequestID: "9", Data: DataRequest{IconSize: 16, ScaleFactor: 1}}
-
-	outb, err := json.Marshal(req)
-
-	if err != nil {
-
-		return err
+	req := AirfoilRequest{Request: "getSourceList", RequestID: "9", Data: DataRequest{IconSize: a.SourceIconSize, ScaleFactor: a.SourceScale}}
 
-	}
-
-	return a.Send(string(outb))
+	return a.sendRequest(req, PriorityLow)
 
 }
 
 func (a *AirfoilConn) FetchMetadata() error {
 
-	req := AirfoilRequest{Request: "getSourceMetadata", RequestID: "13", Data: DataRequest{ScaleFactor: 2, RequestedData: RequestedData{Album: true, RemoteControlAvailable: true, MachineIconAndScreenshot: 64, Bundleid: true, AlbumArt: 64, SourceName: true, Title: true, Icon: 16, TrackMetadataAvailable: true, Artist: true, MachineModel: true, MachineName: true}}}
-
-	outb, err := json.Marshal(req)
-
-	if err != nil {
+	req := AirfoilRequest{Request: "getSourceMetadata", RequestID: "13", Data: DataRequest{ScaleFactor: a.MetadataScale, RequestedData: a.MetadataFields}}
 
-		return err
-
-	}
-
-	return a.Send(string(outb))
+	return a.sendRequest(req, PriorityLow)
 
 }
 
@@ -567,17 +645,11 @@ func (a *AirfoilConn) SetSource(ident string) error {
 		return e
 	}
 
-	req := AirfoilRequest{Request: "selectSource", RequestID: "5", Data: DataRequest{Type: src.Type, Identifier: src.Identifier}}
-
-	outb, err := json.Marshal(req)
-
-	if err != nil {
+	a.markSelecting(src.Identifier)
 
-		return err
-
-	}
+	req := AirfoilRequest{Request: "selectSource", RequestID: "15", Data: DataRequest{Type: src.Type, Identifier: src.Identifier}}
 
-	return a.Send(string(outb))
+	return a.sendRequest(req, PriorityHigh)
 
 }
 
@@ -585,14 +657,6 @@ func (a *AirfoilConn) Disconnect(id string) error {
 
 	req := AirfoilRequest{Request: "disconnectSpeaker", RequestID: "7", Data: DataRequest{LongIdentifier: id}}
 
-	outb, err := json.Marshal(req)
-
-	if err != nil {
-
-		return err
-
-	}
-
-	return a.Send(string(outb))
+	return a.sendRequest(req, PriorityHigh)
 
 }
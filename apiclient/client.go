@@ -0,0 +1,310 @@
+// Package apiclient is a typed client for the /api/v2 routes of the airfoilgo server
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	airfoilgo "github.com/rob121/airfoil-go"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	BaseURL    string //http://host:8080, without /api/v2
+	Token      string //sent as a bearer token when the server has auth.tokens configured
+	HTTPClient *http.Client
+}
+
+// Error is a non 2xx answer from the server. Unwrap gives the matching library error where there is one,
+// so errors.Is(err, airfoilgo.ErrNotFound) and errors.As(err, &ambiguous) work as they do in process
+type Error struct {
+	Status     int
+	Message    string
+	Candidates []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("airfoilgo: %d %s", e.Status, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+
+	switch e.Status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return airfoilgo.ErrNotFound
+	case http.StatusConflict:
+		if len(e.Candidates) > 0 {
+			return &airfoilgo.AmbiguousError{Candidates: e.Candidates}
+		}
+		return airfoilgo.ErrNoConnectedSpeakers
+	case http.StatusServiceUnavailable:
+		return airfoilgo.ErrNotReady
+	}
+
+	return nil
+
+}
+
+// ErrUnauthorized is what a 401 or 403 unwraps to, the token is missing, wrong or lacks the scope
+var ErrUnauthorized = errors.New("not authorized")
+
+type envelope struct {
+	Code    int             `json:"code"`
+	Payload json.RawMessage `json:"payload"`
+	Message string          `json:"message"`
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTPClient: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (c *Client) Speakers(ctx context.Context) ([]airfoilgo.Speaker, error) {
+
+	var out []airfoilgo.Speaker
+
+	return out, c.do(ctx, http.MethodGet, "/speakers", nil, nil, &out)
+
+}
+
+// Speaker looks up one speaker by anything the server resolves: id, MAC prefix, name, alias or slug
+func (c *Client) Speaker(ctx context.Context, id string) (airfoilgo.Speaker, error) {
+
+	var out airfoilgo.Speaker
+
+	return out, c.do(ctx, http.MethodGet, "/speakers/"+url.PathEscape(id), nil, nil, &out)
+
+}
+
+// UpdateSpeaker changes a speaker, a wait above zero holds the call until airfoil confirmed it
+func (c *Client) UpdateSpeaker(ctx context.Context, id string, u SpeakerUpdate, wait time.Duration) (airfoilgo.Speaker, error) {
+
+	var out airfoilgo.Speaker
+
+	return out, c.do(ctx, http.MethodPatch, "/speakers/"+url.PathEscape(id), waitQuery(wait), u, &out)
+
+}
+
+func (c *Client) Connect(ctx context.Context, id string, wait time.Duration) (airfoilgo.Speaker, error) {
+
+	on := true
+
+	return c.UpdateSpeaker(ctx, id, SpeakerUpdate{Connected: &on}, wait)
+
+}
+
+func (c *Client) Disconnect(ctx context.Context, id string, wait time.Duration) (airfoilgo.Speaker, error) {
+
+	off := false
+
+	return c.UpdateSpeaker(ctx, id, SpeakerUpdate{Connected: &off}, wait)
+
+}
+
+// SetVolume sets a speaker volume, 0 to 1
+func (c *Client) SetVolume(ctx context.Context, id string, vol float64, wait time.Duration) (airfoilgo.Speaker, error) {
+
+	return c.UpdateSpeaker(ctx, id, SpeakerUpdate{Volume: &vol}, wait)
+
+}
+
+// Sources returns the source catalog, refresh asks airfoil for the list first
+func (c *Client) Sources(ctx context.Context, refresh bool) (airfoilgo.SourceCatalog, error) {
+
+	var out airfoilgo.SourceCatalog
+	q := url.Values{}
+
+	if refresh {
+		q.Set("refresh", "1")
+	}
+
+	return out, c.do(ctx, http.MethodGet, "/sources", q, nil, &out)
+
+}
+
+func (c *Client) Source(ctx context.Context, query string) (airfoilgo.Source, error) {
+
+	var out airfoilgo.Source
+
+	return out, c.do(ctx, http.MethodGet, "/sources/"+url.PathEscape(query), nil, nil, &out)
+
+}
+
+func (c *Client) ActiveSource(ctx context.Context) (airfoilgo.ActiveSourceChange, error) {
+
+	var out airfoilgo.ActiveSourceChange
+
+	return out, c.do(ctx, http.MethodGet, "/sources/active", nil, nil, &out)
+
+}
+
+// SelectSource makes query the active source, query is a name, type, bundle id, alias or identifier
+func (c *Client) SelectSource(ctx context.Context, query string, wait time.Duration) (airfoilgo.Source, error) {
+
+	var out airfoilgo.Source
+
+	return out, c.do(ctx, http.MethodPut, "/sources/active", waitQuery(wait), SourceSelection{Source: query}, &out)
+
+}
+
+func (c *Client) NowPlaying(ctx context.Context) (airfoilgo.NowPlaying, error) {
+
+	var out airfoilgo.NowPlaying
+
+	return out, c.do(ctx, http.MethodGet, "/nowplaying", nil, nil, &out)
+
+}
+
+func (c *Client) MasterVolume(ctx context.Context) (float64, error) {
+
+	var out MasterVolume
+
+	err := c.do(ctx, http.MethodGet, "/volume", nil, nil, &out)
+
+	return out.Volume, err
+
+}
+
+func (c *Client) SetMasterVolume(ctx context.Context, vol float64) (float64, error) {
+
+	var out MasterVolume
+
+	err := c.do(ctx, http.MethodPut, "/volume", nil, MasterVolumeChange{Volume: &vol}, &out)
+
+	return out.Volume, err
+
+}
+
+func (c *Client) AdjustMasterVolume(ctx context.Context, delta float64) (float64, error) {
+
+	var out MasterVolume
+
+	err := c.do(ctx, http.MethodPut, "/volume", nil, MasterVolumeChange{Delta: &delta}, &out)
+
+	return out.Volume, err
+
+}
+
+func (c *Client) Snapshot(ctx context.Context) (airfoilgo.Snapshot, error) {
+
+	var out airfoilgo.Snapshot
+
+	return out, c.do(ctx, http.MethodGet, "/snapshot", nil, nil, &out)
+
+}
+
+func (c *Client) Desired(ctx context.Context) (airfoilgo.DesiredState, error) {
+
+	var out airfoilgo.DesiredState
+
+	return out, c.do(ctx, http.MethodGet, "/desired", nil, nil, &out)
+
+}
+
+func (c *Client) SetDesired(ctx context.Context, ds airfoilgo.DesiredState) (airfoilgo.DesiredState, error) {
+
+	var out airfoilgo.DesiredState
+
+	return out, c.do(ctx, http.MethodPut, "/desired", nil, ds, &out)
+
+}
+
+func (c *Client) Heartbeat(ctx context.Context) (Heartbeat, error) {
+
+	var out Heartbeat
+
+	return out, c.do(ctx, http.MethodGet, "/heartbeat", nil, nil, &out)
+
+}
+
+func waitQuery(wait time.Duration) url.Values {
+
+	if wait <= 0 {
+		return nil
+	}
+
+	return url.Values{"wait": []string{wait.String()}}
+
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, q url.Values, body interface{}, out interface{}) error {
+
+	u := c.BaseURL + "/api/v2" + path
+
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	var rd io.Reader
+
+	if body != nil {
+
+		b, err := json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+
+		rd = bytes.NewReader(b)
+
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, rd)
+
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	hc := c.HTTPClient
+
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	resp, err := hc.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	var env envelope
+
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return &Error{Status: resp.StatusCode, Message: fmt.Sprintf("unreadable response: %s", err)}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+
+		e := &Error{Status: resp.StatusCode, Message: env.Message}
+		json.Unmarshal(env.Payload, &e.Candidates)
+
+		return e
+
+	}
+
+	if out == nil || len(env.Payload) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(env.Payload, out)
+
+}
@@ -0,0 +1,120 @@
+package apiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	airfoilgo "github.com/rob121/airfoil-go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrorUnwrap(t *testing.T) {
+
+	tests := []struct {
+		err  *Error
+		want error
+	}{
+		{err: &Error{Status: http.StatusUnauthorized}, want: ErrUnauthorized},
+		{err: &Error{Status: http.StatusForbidden}, want: ErrUnauthorized},
+		{err: &Error{Status: http.StatusNotFound}, want: airfoilgo.ErrNotFound},
+		{err: &Error{Status: http.StatusConflict}, want: airfoilgo.ErrNoConnectedSpeakers},
+		{err: &Error{Status: http.StatusServiceUnavailable}, want: airfoilgo.ErrNotReady},
+		{err: &Error{Status: http.StatusBadRequest}},
+		{err: &Error{Status: http.StatusInternalServerError}},
+	}
+
+	for _, tt := range tests {
+
+		got := tt.err.Unwrap()
+
+		if got != tt.want {
+			t.Errorf("%d unwraps to %v, want %v", tt.err.Status, got, tt.want)
+		}
+
+		if tt.want != nil && !errors.Is(tt.err, tt.want) {
+			t.Errorf("%d is not %v", tt.err.Status, tt.want)
+		}
+
+	}
+
+	var amb *airfoilgo.AmbiguousError
+
+	err := error(&Error{Status: http.StatusConflict, Candidates: []string{"112233445566@Living Room", "665544332211@Living Room"}})
+
+	if !errors.As(err, &amb) || len(amb.Candidates) != 2 {
+		t.Fatalf("a conflict with candidates gave %v", err)
+	}
+
+	if errors.Is(err, airfoilgo.ErrNoConnectedSpeakers) {
+		t.Fatal("an ambiguous name is not a missing speaker")
+	}
+
+}
+
+func TestClientDecodesEnvelope(t *testing.T) {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v2/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":401,"payload":null,"message":"Unauthorized"}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"code":200,"payload":{"rttMs":12.4,"lastReply":"2023-06-03T17:54:39.123-05:00","missed":1,"redials":2},"message":"OK"}`)
+
+	})
+
+	mux.HandleFunc("/api/v2/speakers/living room", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"code":409,"payload":["112233445566@Living Room","665544332211@Living Room"],"message":"ambiguous"}`)
+	})
+
+	mux.HandleFunc("/api/v2/speakers", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, `<html>bad gateway</html>`)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := New(srv.URL + "/")
+
+	if _, err := c.Heartbeat(ctx); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("without a token: %v", err)
+	}
+
+	c.Token = "secret"
+
+	hb, err := c.Heartbeat(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hb.RTTMs != 12.4 || hb.LastReply.IsZero() || hb.Missed != 1 || hb.Redials != 2 {
+		t.Fatalf("Heartbeat = %+v", hb)
+	}
+
+	var amb *airfoilgo.AmbiguousError
+
+	if _, err := c.Speaker(ctx, "living room"); !errors.As(err, &amb) || len(amb.Candidates) != 2 {
+		t.Fatalf("ambiguous speaker: %v", err)
+	}
+
+	var apiErr *Error
+
+	//not an envelope at all, the status still comes through
+	if _, err := c.Speakers(ctx); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadGateway {
+		t.Fatalf("unreadable response: %v", err)
+	}
+
+}
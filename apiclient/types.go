@@ -0,0 +1,34 @@
+package apiclient
+
+import (
+	"time"
+)
+
+// SpeakerUpdate is the body of PATCH /api/v2/speakers/{id}, nil fields are left alone
+type SpeakerUpdate struct {
+	Connected *bool    `json:"connected,omitempty"`
+	Volume    *float64 `json:"volume,omitempty"`
+}
+
+// SourceSelection is the body of PUT /api/v2/sources/active
+type SourceSelection struct {
+	Source string `json:"source"`
+}
+
+// MasterVolumeChange is the body of PUT /api/v2/volume, set exactly one of the two
+type MasterVolumeChange struct {
+	Volume *float64 `json:"volume,omitempty"`
+	Delta  *float64 `json:"delta,omitempty"`
+}
+
+// MasterVolume is what GET /api/v2/volume answers
+type MasterVolume struct {
+	Volume float64 `json:"volume"`
+}
+
+type Heartbeat struct {
+	RTTMs     float64   `json:"rttMs"`
+	LastReply time.Time `json:"lastReply"`
+	Missed    int       `json:"missed"`
+	Redials   int       `json:"redials"`
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	client "github.com/rob121/airfoil-go"
+	"github.com/rob121/airfoil-go/apiclient"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// apiServer runs the real router against a piped airfoil, requests other than getSourceList
+// come out of the channel
+func apiServer(t *testing.T) (*apiclient.Client, <-chan map[string]interface{}) {
+
+	t.Helper()
+
+	sent, remote := pipeAirfoil(t,
+		client.Speaker{LongIdentifier: "DC9B9CEFC55C@Kitchen", Name: "Kitchen", Connected: true, Volume: 0.5},
+		client.Speaker{LongIdentifier: "112233445566@Living Room", Name: "Living Room"},
+		client.Speaker{LongIdentifier: "665544332211@Living Room", Name: "Living Room"},
+	)
+
+	rest := answerSources(remote, sent, `[{"identifier":"com.spotify.client","friendlyName":"Spotify"}]`)
+
+	prevRC := rc
+	rc = client.NewReconciler(ca)
+
+	srv := httptest.NewServer(newRouter())
+
+	t.Cleanup(func() {
+		srv.Close()
+		rc = prevRC
+	})
+
+	return apiclient.New(srv.URL), rest
+
+}
+
+func TestAPIClientRoundTrip(t *testing.T) {
+
+	c, sent := apiServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	spks, err := c.Speakers(ctx)
+
+	if err != nil || len(spks) != 3 {
+		t.Fatalf("Speakers = %v, %v", spks, err)
+	}
+
+	spk, err := c.Speaker(ctx, "kitchen")
+
+	if err != nil || spk.LongIdentifier != "DC9B9CEFC55C@Kitchen" || spk.Volume != 0.5 {
+		t.Fatalf("Speaker = %+v, %v", spk, err)
+	}
+
+	if _, err := c.Speaker(ctx, "garage"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("unknown speaker: %v", err)
+	}
+
+	var amb *client.AmbiguousError
+
+	if _, err := c.Speaker(ctx, "living room"); !errors.As(err, &amb) || len(amb.Candidates) != 2 {
+		t.Fatalf("ambiguous speaker: %v", err)
+	}
+
+	if _, err := c.SetVolume(ctx, "kitchen", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := nextRequest(t, sent)
+	data, _ := req["data"].(map[string]interface{})
+
+	if req["request"] != "setSpeakerVolume" || data["volume"] != 0.0 {
+		t.Fatalf("unexpected request %v", req)
+	}
+
+	if _, err := c.SetVolume(ctx, "kitchen", 1.5, 0); err == nil {
+		t.Fatal("volume 1.5 was accepted")
+	}
+
+	cat, err := c.Sources(ctx, true)
+
+	if err != nil || len(cat.All()) != 1 {
+		t.Fatalf("Sources = %+v, %v", cat, err)
+	}
+
+	src, err := c.Source(ctx, "spotify")
+
+	if err != nil || src.Identifier != "com.spotify.client" {
+		t.Fatalf("Source = %+v, %v", src, err)
+	}
+
+	if src, err = c.SelectSource(ctx, "spotify", 0); err != nil || src.Identifier != "com.spotify.client" {
+		t.Fatalf("SelectSource = %+v, %v", src, err)
+	}
+
+	if req := nextRequest(t, sent); req["request"] != "selectSource" {
+		t.Fatalf("unexpected request %v", req)
+	}
+
+	if vol, err := c.MasterVolume(ctx); err != nil || vol != 0.5 {
+		t.Fatalf("MasterVolume = %v, %v", vol, err)
+	}
+
+	snap, err := c.Snapshot(ctx)
+
+	if err != nil || snap.State != client.StateReady || len(snap.Speakers) != 3 {
+		t.Fatalf("Snapshot = %+v, %v", snap, err)
+	}
+
+	if _, err := c.NowPlaying(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	//the field names on the wire, not just what the client decodes
+	resp, err := http.Get(c.BaseURL + "/api/v2/heartbeat")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hb struct {
+		Payload map[string]interface{} `json:"payload"`
+	}
+
+	json.NewDecoder(resp.Body).Decode(&hb)
+	resp.Body.Close()
+
+	for _, key := range []string{"rttMs", "lastReply", "missed", "redials"} {
+
+		if _, ok := hb.Payload[key]; !ok {
+			t.Fatalf("heartbeat has no %s: %v", key, hb.Payload)
+		}
+
+	}
+
+	quiet := 0.2
+
+	ds, err := c.SetDesired(ctx, client.DesiredState{Speakers: map[string]client.DesiredSpeaker{"kitchen": {Volume: &quiet}}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := ds.Speakers["DC9B9CEFC55C@Kitchen"]; !ok || got.Volume == nil || *got.Volume != quiet {
+		t.Fatalf("SetDesired = %+v", ds)
+	}
+
+	if ds, err = c.Desired(ctx); err != nil || len(ds.Speakers) != 1 {
+		t.Fatalf("Desired = %+v, %v", ds, err)
+	}
+
+}
+
+func TestAPIClientUnauthorized(t *testing.T) {
+
+	c, _ := apiServer(t)
+
+	prevAuth, prevAudit := auth, audit
+
+	defer func() {
+		auth, audit = prevAuth, prevAudit
+	}()
+
+	auth = authConfig{Tokens: []credential{{Name: "wall-display", Token: "r", Scope: "read"}}}
+	audit = &auditLog{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Speakers(ctx); !errors.Is(err, apiclient.ErrUnauthorized) {
+		t.Fatalf("without a token: %v", err)
+	}
+
+	c.Token = "r"
+
+	if _, err := c.Speakers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Connect(ctx, "kitchen", 0); !errors.Is(err, apiclient.ErrUnauthorized) {
+		t.Fatalf("read scope connecting: %v", err)
+	}
+
+}
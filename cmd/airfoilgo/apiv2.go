@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	client "github.com/rob121/airfoil-go"
+	"github.com/rob121/airfoil-go/apiclient"
+	"net/http"
+	"time"
+)
+
+const apiV2Prefix = "/api/v2"
+
+// requestError is a problem with what the caller sent, answered with a 400
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, v ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, v...)}
+}
+
+// checkVolume is the one range every route, websocket and mqtt command accepts, 0 is silence
+func checkVolume(vol float64) error {
+
+	if vol < 0 || vol > 1 {
+		return badRequest("volume must be between 0 and 1")
+	}
+
+	return nil
+
+}
+
+// v2Routes is the /api/v2 surface, registerV2 serves it and /openapi.json describes it
+func v2Routes() []apiRoute {
+
+	return []apiRoute{
+		{Method: http.MethodGet, Path: "/speakers", Summary: "All speakers sorted by name", Handler: v2SpeakersHandler, Result: []client.Speaker{}},
+		{Method: http.MethodGet, Path: "/speakers/{id}", Summary: "One speaker by id, MAC prefix, name, alias or slug", Handler: v2SpeakerHandler, Result: client.Speaker{}},
+		{Method: http.MethodPatch, Path: "/speakers/{id}", Summary: "Connect, disconnect or change the volume of a speaker", Handler: v2SpeakerPatchHandler, Body: apiclient.SpeakerUpdate{}, Result: client.Speaker{}, Status: http.StatusAccepted, Query: []apiParam{waitParam}},
+		{Method: http.MethodGet, Path: "/sources", Summary: "The source catalog in airfoil's order", Handler: v2SourcesHandler, Result: client.SourceCatalog{}, Query: []apiParam{{Name: "refresh", Type: "boolean", Description: "ask airfoil for the source list first"}}},
+		{Method: http.MethodGet, Path: "/sources/active", Summary: "The active source, when and by whom it was changed", Handler: v2ActiveSourceHandler, Result: client.ActiveSourceChange{}},
+		{Method: http.MethodPut, Path: "/sources/active", Summary: "Select a source by name, type, bundle id, alias or identifier", Handler: v2SelectSourceHandler, Body: apiclient.SourceSelection{}, Result: client.Source{}, Status: http.StatusAccepted, Query: []apiParam{waitParam}},
+		{Method: http.MethodGet, Path: "/sources/{id}", Summary: "One source by name, type, bundle id, alias or identifier", Handler: v2SourceHandler, Result: client.Source{}},
+		{Method: http.MethodGet, Path: "/nowplaying", Summary: "Track metadata of the active source", Handler: v2NowPlayingHandler, Result: client.NowPlaying{}},
+		{Method: http.MethodGet, Path: "/volume", Summary: "Master volume, the level of the loudest connected speaker", Handler: v2VolumeHandler, Result: apiclient.MasterVolume{}},
+		{Method: http.MethodPut, Path: "/volume", Summary: "Set or adjust the master volume", Handler: v2SetVolumeHandler, Body: apiclient.MasterVolumeChange{}, Result: apiclient.MasterVolume{}, Status: http.StatusAccepted},
+		{Method: http.MethodGet, Path: "/snapshot", Summary: "The whole library state", Handler: v2SnapshotHandler, Result: client.Snapshot{}},
+		{Method: http.MethodGet, Path: "/desired", Summary: "The state the reconciler works toward", Handler: v2DesiredHandler, Result: client.DesiredState{}},
+		{Method: http.MethodPut, Path: "/desired", Summary: "Replace the desired state", Handler: v2SetDesiredHandler, Body: client.DesiredState{}, Result: client.DesiredState{}},
+		{Method: http.MethodGet, Path: "/heartbeat", Summary: "Session heartbeat", Handler: v2HeartbeatHandler, Result: apiclient.Heartbeat{}},
+	}
+
+}
+
+// registerV2 adds the resource style api, state only changes on PATCH / PUT and errors come back
+// with a matching http status
+func registerV2(r *mux.Router) {
+
+	for _, rt := range v2Routes() {
+		r.HandleFunc(rt.Path, rt.Handler).Methods(rt.Method)
+	}
+
+}
+
+func v2SpeakersHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", ca.Snapshot().Speakers)
+
+}
+
+func v2SpeakerHandler(w http.ResponseWriter, r *http.Request) {
+
+	spk, err := ca.ResolveSpeaker(mux.Vars(r)["id"])
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondStatus(w, http.StatusOK, "OK", spk)
+
+}
+
+// PATCH {"connected":true,"volume":0.4}, either field can be left out
+func v2SpeakerPatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	spk, err := ca.ResolveSpeaker(mux.Vars(r)["id"])
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if err := allowSpeaker(r, spk); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	var p apiclient.SpeakerUpdate
+
+	if err := decodeBody(w, r, &p); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if p.Connected == nil && p.Volume == nil {
+		respondError(w, badRequest("nothing to change, set connected and/or volume"))
+		return
+	}
+
+	if p.Volume != nil {
+
+		if err := checkVolume(*p.Volume); err != nil {
+			respondError(w, err)
+			return
+		}
+
+	}
+
+	id := spk.LongIdentifier
+
+	err = confirm(r, func() error {
+
+		if p.Connected != nil {
+
+			var cerr error
+
+			if *p.Connected {
+				cerr = ca.Connect(id)
+			} else {
+				cerr = ca.Disconnect(id)
+			}
+
+			if cerr != nil {
+				return cerr
+			}
+
+		}
+
+		if p.Volume != nil {
+			return ca.Volume(id, *p.Volume)
+		}
+
+		return nil
+
+	}, func(ctx context.Context) error {
+
+		if p.Connected != nil {
+
+			var cerr error
+
+			if *p.Connected {
+				cerr = ca.ConnectAndWait(ctx, id)
+			} else {
+				cerr = ca.DisconnectAndWait(ctx, id)
+			}
+
+			if cerr != nil {
+				return cerr
+			}
+
+		}
+
+		if p.Volume != nil {
+			return ca.VolumeAndWait(ctx, id, *p.Volume)
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if cur, gerr := ca.GetSpeaker(id); gerr == nil {
+		spk = *cur
+	}
+
+	respondStatus(w, changeStatus(r), "OK", spk)
+
+}
+
+// ?refresh=1 asks airfoil for the list first instead of answering from what is known
+func v2SourcesHandler(w http.ResponseWriter, r *http.Request) {
+
+	if g := r.URL.Query().Get("refresh"); g != "" && g != "0" && g != "false" {
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		if err := ca.RefreshSources(ctx); err != nil {
+			respondError(w, err)
+			return
+		}
+
+	}
+
+	respondStatus(w, http.StatusOK, "OK", ca.Catalog())
+
+}
+
+func v2SourceHandler(w http.ResponseWriter, r *http.Request) {
+
+	src, err := ca.ResolveSource(mux.Vars(r)["id"])
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondStatus(w, http.StatusOK, "OK", src)
+
+}
+
+func v2ActiveSourceHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", ca.ActiveSourceChange())
+
+}
+
+// PUT {"source":"Spotify"}, anything ResolveSource understands
+func v2SelectSourceHandler(w http.ResponseWriter, r *http.Request) {
+
+	var sel apiclient.SourceSelection
+
+	if err := decodeBody(w, r, &sel); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if sel.Source == "" {
+		respondError(w, badRequest("source is required"))
+		return
+	}
+
+	var src client.Source
+
+	err := confirm(r, func() error {
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		var serr error
+		src, serr = ca.SelectSource(ctx, sel.Source)
+		return serr
+
+	}, func(ctx context.Context) error {
+
+		var serr error
+		src, serr = ca.SelectSourceAndWait(ctx, sel.Source)
+		return serr
+
+	})
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondStatus(w, changeStatus(r), "OK", src)
+
+}
+
+func v2NowPlayingHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", ca.NowPlaying())
+
+}
+
+func v2VolumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", apiclient.MasterVolume{Volume: ca.MasterVolume()})
+
+}
+
+// PUT {"volume":0.5} or {"delta":-0.1}, the master volume has no confirmation so this is always a 202
+func v2SetVolumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	var c apiclient.MasterVolumeChange
+
+	if err := decodeBody(w, r, &c); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if (c.Volume == nil) == (c.Delta == nil) {
+		respondError(w, badRequest("set exactly one of volume or delta"))
+		return
+	}
+
+	var err error
+
+	if c.Volume != nil {
+
+		if err := checkVolume(*c.Volume); err != nil {
+			respondError(w, err)
+			return
+		}
+
+		err = ca.SetMasterVolume(*c.Volume)
+
+	} else {
+		err = ca.AdjustMasterVolume(*c.Delta)
+	}
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondStatus(w, http.StatusAccepted, "OK", apiclient.MasterVolume{Volume: ca.MasterVolume()})
+
+}
+
+func v2SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", ca.Snapshot())
+
+}
+
+func v2DesiredHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", rc.Desired())
+
+}
+
+func v2SetDesiredHandler(w http.ResponseWriter, r *http.Request) {
+
+	var ds client.DesiredState
+
+	if err := decodeBody(w, r, &ds); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	resolved, err := resolveDesired(ds)
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	rc.SetDesired(resolved)
+
+	respondStatus(w, http.StatusOK, "OK", rc.Desired())
+
+}
+
+func v2HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", heartbeatStatus())
+
+}
+
+// 200 once airfoil confirmed the change (?wait=), 202 when it was only sent
+func changeStatus(r *http.Request) int {
+
+	if _, ok := waitTimeout(r); ok {
+		return http.StatusOK
+	}
+
+	return http.StatusAccepted
+
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: %s", err)
+	}
+
+	return nil
+
+}
+
+// statusFor maps library errors onto http status codes
+func statusFor(err error) int {
+
+	var req *requestError
+	var ae *authError
+	var amb *client.AmbiguousError
+	var tmo *client.TimeoutError
+
+	switch {
+	case errors.As(err, &ae):
+		return ae.status
+	case errors.As(err, &req):
+		return http.StatusBadRequest
+	case errors.Is(err, errBusy):
+		return http.StatusTooManyRequests
+	case errors.Is(err, client.ErrNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &amb), errors.Is(err, client.ErrNoConnectedSpeakers):
+		return http.StatusConflict
+	case errors.Is(err, client.ErrNotReady), errors.Is(err, client.ErrConnClosed), errors.Is(err, client.ErrQueueFull):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &tmo), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+
+}
+
+// respondError puts the error in the message, ambiguous lookups list their candidates in the payload
+func respondError(w http.ResponseWriter, err error) {
+
+	var payload interface{}
+	var amb *client.AmbiguousError
+
+	if errors.As(err, &amb) {
+		payload = amb.Candidates
+	}
+
+	respondStatus(w, statusFor(err), err.Error(), payload)
+
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	client "github.com/rob121/airfoil-go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestV2SpeakerPatchVolumeZero(t *testing.T) {
+
+	sent, _ := pipeAirfoil(t, client.Speaker{LongIdentifier: "DC9B9CEFC55C@Kitchen", Name: "Kitchen", Connected: true, Volume: 0.5})
+
+	r := mux.NewRouter()
+	registerV2(r.PathPrefix(apiV2Prefix).Subrouter())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, apiV2Prefix+"/speakers/kitchen", strings.NewReader(`{"volume":0}`)))
+
+	if w.Code >= 300 {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	req := nextRequest(t, sent)
+	data, _ := req["data"].(map[string]interface{})
+
+	if req["request"] != "setSpeakerVolume" || data["longIdentifier"] != "DC9B9CEFC55C@Kitchen" {
+		t.Fatalf("unexpected request %v", req)
+	}
+
+	if v, ok := data["volume"]; !ok || v != 0.0 {
+		t.Fatalf("volume 0 didn't reach airfoil: %v", req)
+	}
+
+}
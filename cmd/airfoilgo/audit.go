@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	client "github.com/rob121/airfoil-go"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditOriginHTTP       = "http"
+	auditOriginWebsocket  = "websocket"
+	auditOriginMQTT       = "mqtt"
+	auditOriginReconciler = "reconciler"
+
+	//without a file the log only lives in memory
+	auditMemory = 1000
+
+	//how much of a request body ends up in the entry
+	auditBodyLimit = 16 * 1024
+)
+
+// auditEntry is one state changing command, whoever sent it
+type auditEntry struct {
+	Time      time.Time   `json:"time"`
+	Origin    string      `json:"origin"`
+	Remote    string      `json:"remote,omitempty"`
+	Principal string      `json:"principal,omitempty"` //token or user name when auth is on
+	Topic     string      `json:"topic,omitempty"`
+	Action    string      `json:"action"`
+	Target    string      `json:"target,omitempty"`
+	Params    interface{} `json:"params,omitempty"`
+	Status    int         `json:"status"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// auditLog appends entries as json lines to file, rotated once it reaches audit.max_size_mb
+type auditLog struct {
+	file *rotatingFile
+
+	mu     sync.Mutex
+	recent []auditEntry
+}
+
+var audit = &auditLog{}
+
+func loadAudit() {
+
+	path := conf.GetString("audit.file")
+
+	if path == "" {
+		return
+	}
+
+	file, err := openRotating(path, int64(conf.GetInt("audit.max_size_mb"))<<20, conf.GetInt("audit.keep"))
+
+	if err != nil {
+		log.Fatalf("Unable to open audit log %s", err)
+	}
+
+	audit.file = file
+
+}
+
+func (al *auditLog) record(e auditEntry) {
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.file == nil {
+
+		al.recent = append(al.recent, e)
+
+		if len(al.recent) > auditMemory {
+			al.recent = al.recent[len(al.recent)-auditMemory:]
+		}
+
+		return
+
+	}
+
+	line, err := json.Marshal(e)
+
+	if err != nil {
+		log.Printf("Audit Error %s\n", err)
+		return
+	}
+
+	if _, err := al.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Audit Error %s\n", err)
+	}
+
+}
+
+// newest returns up to limit entries match accepts, newest first. only the file list is taken under
+// the lock, a query reading through the rotated files doesn't hold up the commands being recorded
+func (al *auditLog) newest(limit int, match func(auditEntry) bool) ([]auditEntry, error) {
+
+	al.mu.Lock()
+
+	var recent []auditEntry
+	var paths []string
+
+	if al.file == nil {
+		recent = append(recent, al.recent...)
+	} else {
+		paths = al.file.files()
+	}
+
+	al.mu.Unlock()
+
+	out := []auditEntry{}
+
+	//kept oldest first, so each batch is walked from the back. true once there are enough
+	collect := func(entries []auditEntry, before time.Time) bool {
+
+		for i := len(entries) - 1; i >= 0; i-- {
+
+			e := entries[i]
+
+			//the log rotated since the newer file was read, this part was seen already
+			if !before.IsZero() && !e.Time.Before(before) {
+				continue
+			}
+
+			if match != nil && !match(e) {
+				continue
+			}
+
+			out = append(out, e)
+
+			if len(out) >= limit {
+				return true
+			}
+
+		}
+
+		return false
+
+	}
+
+	if paths == nil {
+		collect(recent, time.Time{})
+		return out, nil
+	}
+
+	var before time.Time
+
+	for i := len(paths) - 1; i >= 0; i-- {
+
+		entries, err := readAuditFile(paths[i])
+
+		if err != nil {
+			return out, err
+		}
+
+		if collect(entries, before) {
+			break
+		}
+
+		if len(entries) > 0 && (before.IsZero() || entries[0].Time.Before(before)) {
+			before = entries[0].Time
+		}
+
+	}
+
+	return out, nil
+
+}
+
+// readAuditFile is every entry in one file, oldest first. a file that was never written is empty
+func readAuditFile(path string) ([]auditEntry, error) {
+
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var out []auditEntry
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+
+	for sc.Scan() {
+
+		var e auditEntry
+
+		//a line cut short by a crash is skipped, not the whole file
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			out = append(out, e)
+		}
+
+	}
+
+	return out, sc.Err()
+
+}
+
+// auditStatus is what the request's response said, legacy routes answer 200 with the real code in the body
+type auditStatus struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (as *auditStatus) WriteHeader(status int) {
+	as.status = status
+	as.ResponseWriter.WriteHeader(status)
+}
+
+func (as *auditStatus) Write(b []byte) (int, error) {
+
+	if as.status == 0 {
+		as.status = http.StatusOK
+	}
+
+	if room := 4096 - as.body.Len(); room > 0 {
+
+		if len(b) < room {
+			room = len(b)
+		}
+
+		as.body.Write(b[:room])
+
+	}
+
+	return as.ResponseWriter.Write(b)
+
+}
+
+// changesState is every request that needs more than the read scope, except the admin only lookups
+func changesState(r *http.Request) bool {
+
+	if strings.HasPrefix(r.URL.Path, "/debug/") || r.URL.Path == "/api/audit" {
+		return false
+	}
+
+	need, _ := requiredScope(r)
+
+	return need > scopeRead
+
+}
+
+// auditName is the principal as the log shows it, nobody when auth is off
+func (p *principal) auditName() string {
+
+	if p == anyone {
+		return ""
+	}
+
+	return p.name
+
+}
+
+// Audit records every state changing request after it ran, rejected ones included. What Authenticate
+// turns away never gets here, it records that itself with auditRejected
+func Audit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !changesState(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		e := httpAuditEntry(r)
+		e.Principal = principalFrom(r).auditName()
+
+		as := &auditStatus{ResponseWriter: w}
+
+		h.ServeHTTP(as, r)
+
+		e.Status = as.status
+
+		var env JsonResp
+
+		if json.Unmarshal(as.body.Bytes(), &env) == nil && env.Code != 0 {
+
+			e.Status = env.Code
+
+			if env.Code >= 300 {
+
+				e.Error = env.Message
+
+				//the legacy routes often put the reason in the payload
+				if msg, ok := env.Payload.(string); ok && env.Message == "Error" && msg != "" {
+					e.Error = msg
+				}
+
+			}
+
+		}
+
+		audit.record(e)
+
+	})
+}
+
+// auditRejected records a state changing request that failed authentication or lacked the scope,
+// name is whoever it claimed to be
+func auditRejected(r *http.Request, name string, status int, msg string) {
+
+	if !changesState(r) {
+		return
+	}
+
+	e := httpAuditEntry(r)
+	e.Principal = name
+	e.Status = status
+	e.Error = msg
+
+	audit.record(e)
+
+}
+
+// httpAuditEntry is what the request itself says, the handler still gets the whole body
+func httpAuditEntry(r *http.Request) auditEntry {
+
+	e := auditEntry{
+		Time:   time.Now(),
+		Origin: auditOriginHTTP,
+		Remote: r.RemoteAddr,
+		Action: r.Method + " " + r.URL.Path,
+	}
+
+	if route := mux.CurrentRoute(r); route != nil {
+
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			e.Action = r.Method + " " + tmpl
+		}
+
+	}
+
+	vars := mux.Vars(r)
+
+	if id, ok := vars["id"]; ok {
+		e.Target = id
+	}
+
+	params := make(map[string]interface{})
+
+	for k, v := range vars {
+
+		if k != "id" {
+			params[k] = v
+		}
+
+	}
+
+	for k, v := range r.URL.Query() {
+
+		if k != "access_token" {
+			params[k] = strings.Join(v, ",")
+		}
+
+	}
+
+	//keep a copy of the body and hand the handler the same bytes
+	if r.Body != nil {
+
+		head, _ := io.ReadAll(io.LimitReader(r.Body, auditBodyLimit))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+		if len(head) > 0 {
+
+			if json.Valid(head) {
+				params["body"] = json.RawMessage(head)
+			} else {
+				params["body"] = string(head)
+			}
+
+		}
+
+	}
+
+	if len(params) > 0 {
+		e.Params = params
+	}
+
+	return e
+
+}
+
+// auditCommand records a websocket or mqtt command, err nil for success
+func auditCommand(e auditEntry, err error) {
+
+	e.Status = http.StatusOK
+
+	if err != nil {
+		e.Status = statusFor(err)
+		e.Error = err.Error()
+	}
+
+	audit.record(e)
+
+}
+
+// auditReconciler records the corrections the reconciler sends, drift it only notices isn't a command
+func auditReconciler() {
+
+	ca.Listen(func(ev client.Event) {
+
+		d, ok := ev.Data.(client.Drift)
+
+		if ev.Type != client.EventDrift || !ok || !d.Corrected {
+			return
+		}
+
+		var err error
+
+		if d.Error != "" {
+			err = fmt.Errorf("%s", d.Error)
+		}
+
+		auditCommand(auditEntry{
+			Origin: auditOriginReconciler,
+			Action: d.Field,
+			Target: d.Speaker,
+			Params: map[string]interface{}{"want": d.Want, "have": d.Have, "attempt": d.Attempt},
+		}, err)
+
+	})
+
+}
+
+// GET /api/audit?since=&until=&origin=&action=&target=&principal=&limit=, newest first
+func httpAuditHandler(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+
+	var since, until time.Time
+
+	for key, t := range map[string]*time.Time{"since": &since, "until": &until} {
+
+		v := q.Get(key)
+
+		if v == "" {
+			continue
+		}
+
+		parsed, err := parseSince(v)
+
+		if err != nil {
+			respondError(w, badRequest("%s: %s", key, err))
+			return
+		}
+
+		*t = parsed
+
+	}
+
+	limit := 100
+
+	if v := q.Get("limit"); v != "" {
+
+		n, err := strconv.Atoi(v)
+
+		if err != nil || n < 1 {
+			respondError(w, badRequest("limit must be a positive number"))
+			return
+		}
+
+		limit = n
+
+	}
+
+	//a target matches the raw value or, for speakers, whatever the query resolves to
+	targets := map[string]bool{}
+
+	if t := q.Get("target"); t != "" {
+
+		targets[strings.ToLower(t)] = true
+
+		if ca != nil {
+
+			if spk, err := ca.ResolveSpeaker(t); err == nil {
+				targets[strings.ToLower(spk.LongIdentifier)] = true
+			}
+
+		}
+
+	}
+
+	out, err := audit.newest(limit, func(e auditEntry) bool {
+
+		switch {
+		case !since.IsZero() && e.Time.Before(since):
+			return false
+		case !until.IsZero() && e.Time.After(until):
+			return false
+		case q.Get("origin") != "" && !strings.EqualFold(q.Get("origin"), e.Origin):
+			return false
+		case q.Get("action") != "" && !strings.Contains(strings.ToLower(e.Action), strings.ToLower(q.Get("action"))):
+			return false
+		case q.Get("principal") != "" && q.Get("principal") != e.Principal:
+			return false
+		case len(targets) > 0 && !auditTargetMatches(e.Target, targets):
+			return false
+		}
+
+		return true
+
+	})
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondStatus(w, http.StatusOK, "OK", out)
+
+}
+
+func auditTargetMatches(target string, targets map[string]bool) bool {
+
+	if targets[strings.ToLower(target)] {
+		return true
+	}
+
+	//entries keep what the caller typed, resolve it the same way
+	if ca != nil && target != "" {
+
+		if spk, err := ca.ResolveSpeaker(target); err == nil {
+			return targets[strings.ToLower(spk.LongIdentifier)]
+		}
+
+	}
+
+	return false
+
+}
+
+// parseSince takes RFC 3339 or a duration back from now, like 1h
+func parseSince(v string) (time.Time, error) {
+
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, v)
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditNewestAcrossRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	file, err := openRotating(path, 400, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al := &auditLog{file: file}
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 30; i++ {
+		al.record(auditEntry{Time: base.Add(time.Duration(i) * time.Second), Origin: "http", Action: fmt.Sprintf("GET /connect/%d", i)})
+	}
+
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Fatal("the log never rotated")
+	}
+
+	all, err := al.newest(100, nil)
+
+	if err != nil || len(all) != 30 {
+		t.Fatalf("newest kept %d entries, %v", len(all), err)
+	}
+
+	for i, e := range all {
+
+		if want := fmt.Sprintf("GET /connect/%d", 29-i); e.Action != want {
+			t.Fatalf("entry %d is %s, want %s", i, e.Action, want)
+		}
+
+	}
+
+	odd, err := al.newest(4, func(e auditEntry) bool {
+		return strings.HasSuffix(e.Action, "1") || strings.HasSuffix(e.Action, "3") || strings.HasSuffix(e.Action, "5") || strings.HasSuffix(e.Action, "7") || strings.HasSuffix(e.Action, "9")
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+
+	for _, e := range odd {
+		got = append(got, strings.TrimPrefix(e.Action, "GET /connect/"))
+	}
+
+	if strings.Join(got, ",") != "29,27,25,23" {
+		t.Fatalf("newest 4 odd are %v", got)
+	}
+
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	client "github.com/rob121/airfoil-go"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// scope is what a token or user may do, each one includes the ones below it
+type scope int
+
+const (
+	scopeRead    scope = iota + 1 //look, no changes
+	scopeControl                  //connect, disconnect, volume and sources
+	scopeAdmin                    //the desired state, which decides for every speaker
+)
+
+func (s scope) String() string {
+
+	switch s {
+	case scopeRead:
+		return "read"
+	case scopeControl:
+		return "control"
+	case scopeAdmin:
+		return "admin"
+	}
+
+	return "none"
+
+}
+
+func parseScope(s string) (scope, error) {
+
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "read":
+		return scopeRead, nil
+	case "control":
+		return scopeControl, nil
+	case "admin":
+		return scopeAdmin, nil
+	}
+
+	return 0, fmt.Errorf("unknown scope %q", s)
+
+}
+
+// credential is one entry of auth.tokens or auth.users in the config, Speakers limits what it may
+// change to those speakers (any identifier the resolver understands), left out it may change all of them
+type credential struct {
+	Name     string
+	Token    string
+	Password string
+	Scope    string
+	Speakers []string
+}
+
+type authConfig struct {
+	Tokens []credential
+	Users  []credential
+}
+
+// principal is who made the request
+type principal struct {
+	name     string
+	scope    scope
+	speakers []string //nil for every speaker
+}
+
+type authKey struct{}
+
+// authError is answered with its own status, 401 for who are you and 403 for not allowed
+type authError struct {
+	status int
+	msg    string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+var auth authConfig
+
+// anyone is the principal when no credentials are configured, the server is as open as it always was
+var anyone = &principal{name: "anonymous", scope: scopeAdmin}
+
+func loadAuth() {
+
+	if !conf.IsSet("auth") {
+		log.Println("HTTP authentication is off, set auth.tokens or auth.users to turn it on")
+		return
+	}
+
+	var ac authConfig
+
+	if err := conf.UnmarshalKey("auth", &ac); err != nil {
+		log.Fatalf("Invalid auth config %s", err)
+	}
+
+	//an entry that can't be used is a config mistake, failing now beats an open or locked out server
+	for _, c := range append(append([]credential{}, ac.Tokens...), ac.Users...) {
+
+		if _, err := parseScope(c.Scope); err != nil {
+			log.Fatalf("Invalid auth config for %s: %s", c.Name, err)
+		}
+
+	}
+
+	for _, c := range ac.Tokens {
+
+		if c.Token == "" {
+			log.Fatalf("Invalid auth config, token %s has no token", c.Name)
+		}
+
+	}
+
+	for _, c := range ac.Users {
+
+		if c.Name == "" || c.Password == "" {
+			log.Fatalf("Invalid auth config, users need a name and a password")
+		}
+
+	}
+
+	auth = ac
+
+}
+
+func (ac authConfig) enabled() bool {
+	return len(ac.Tokens) > 0 || len(ac.Users) > 0
+}
+
+// authenticate finds the principal for r, nil when the credentials don't match anything
+func (ac authConfig) authenticate(r *http.Request) *principal {
+
+	if user, pass, ok := r.BasicAuth(); ok {
+
+		for _, c := range ac.Users {
+
+			if subtle.ConstantTimeCompare([]byte(user), []byte(c.Name)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(c.Password)) == 1 {
+				return c.principal()
+			}
+
+		}
+
+		return nil
+
+	}
+
+	token := r.URL.Query().Get("access_token") //EventSource and browser websockets can't set headers
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+
+	if token == "" {
+		return nil
+	}
+
+	for _, c := range ac.Tokens {
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+			return c.principal()
+		}
+
+	}
+
+	return nil
+
+}
+
+func (c credential) principal() *principal {
+
+	s, _ := parseScope(c.Scope)
+
+	p := &principal{name: c.Name, scope: s}
+
+	if len(c.Speakers) > 0 {
+		p.speakers = c.Speakers
+	}
+
+	return p
+
+}
+
+// permits checks the scope, every is for changes that reach all speakers at once
+func (p *principal) permits(need scope, every bool) error {
+
+	if p.scope < need {
+		return &authError{status: http.StatusForbidden, msg: fmt.Sprintf("%s needs the %s scope", p.name, need)}
+	}
+
+	if every && p.speakers != nil {
+		return &authError{status: http.StatusForbidden, msg: fmt.Sprintf("%s is limited to some speakers", p.name)}
+	}
+
+	return nil
+
+}
+
+// allows checks spk against the allow-list, the entries are resolved each time so they follow renames
+func (p *principal) allows(spk client.Speaker) error {
+
+	if p.speakers == nil {
+		return nil
+	}
+
+	for _, q := range p.speakers {
+
+		if q == spk.LongIdentifier {
+			return nil
+		}
+
+		if s, err := ca.ResolveSpeaker(q); err == nil && s.LongIdentifier == spk.LongIdentifier {
+			return nil
+		}
+
+	}
+
+	return &authError{status: http.StatusForbidden, msg: fmt.Sprintf("%s may not change %s", p.name, spk.Name)}
+
+}
+
+func principalFrom(r *http.Request) *principal {
+
+	if p, ok := r.Context().Value(authKey{}).(*principal); ok {
+		return p
+	}
+
+	return anyone
+
+}
+
+// allowSpeaker is for handlers that change one speaker
+func allowSpeaker(r *http.Request, spk client.Speaker) error {
+	return principalFrom(r).allows(spk)
+}
+
+// requiredScope is what the route needs, every when the change isn't limited to one speaker
+func requiredScope(r *http.Request) (scope, bool) {
+
+	path := r.URL.Path
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+
+	switch {
+	case strings.HasPrefix(path, "/debug/"), path == "/api/audit":
+		return scopeAdmin, false
+	case path == "/desired" || path == apiV2Prefix+"/desired":
+		if write {
+			return scopeAdmin, true
+		}
+	case strings.HasPrefix(path, "/mastervolume/"), path == apiV2Prefix+"/volume" && write:
+		return scopeControl, true
+	//the source plays on every connected speaker, so it is a change to all of them
+	case strings.HasPrefix(path, "/source/"), path == apiV2Prefix+"/sources/active" && write:
+		return scopeControl, true
+	case strings.HasPrefix(path, "/connect/"), strings.HasPrefix(path, "/disconnect/"), strings.HasPrefix(path, "/toggleconn/"), strings.HasPrefix(path, "/volume/"):
+		return scopeControl, false
+	case path == "/api/batch":
+		return scopeControl, false
+	case strings.HasPrefix(path, apiV2Prefix+"/") && write:
+		return scopeControl, false
+	}
+
+	return scopeRead, false
+
+}
+
+// Authenticate runs before everything else, the answers carry real status codes on every route so
+// browsers and http clients know to send credentials
+func Authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !auth.enabled() || isProbe(r.URL.Path) || isUI(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		p := auth.authenticate(r)
+
+		if p == nil {
+
+			if len(auth.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="airfoilgo"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="airfoilgo"`)
+			}
+
+			//the user name is no secret and shows who is being guessed at
+			name, _, _ := r.BasicAuth()
+
+			auditRejected(r, name, http.StatusUnauthorized, "Unauthorized")
+			respondStatus(w, http.StatusUnauthorized, "Unauthorized", nil)
+			return
+
+		}
+
+		if err := p.permits(requiredScope(r)); err != nil {
+			auditRejected(r, p.auditName(), http.StatusForbidden, err.Error())
+			respondStatus(w, http.StatusForbidden, err.Error(), nil)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, p)))
+
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredScope(t *testing.T) {
+
+	tests := []struct {
+		method string
+		path   string
+		scope  scope
+		every  bool
+	}{
+		{http.MethodGet, "/speakers", scopeRead, false},
+		{http.MethodGet, "/connect/kitchen", scopeControl, false},
+		{http.MethodGet, "/disconnect/kitchen", scopeControl, false},
+		{http.MethodGet, "/toggleconn/kitchen", scopeControl, false},
+		{http.MethodGet, "/volume/kitchen/40", scopeControl, false},
+		{http.MethodGet, "/source/spotify", scopeControl, true},
+		{http.MethodGet, "/mastervolume/40", scopeControl, true},
+		{http.MethodGet, "/mastervolume/adjust/-5", scopeControl, true},
+		{http.MethodGet, "/mastervolume", scopeRead, false},
+		{http.MethodGet, "/desired", scopeRead, false},
+		{http.MethodPost, "/desired", scopeAdmin, true},
+		{http.MethodGet, "/debug/state", scopeAdmin, false},
+		{http.MethodGet, "/api/audit", scopeAdmin, false},
+		{http.MethodGet, "/api/history", scopeRead, false},
+		{http.MethodPost, "/api/batch", scopeControl, false},
+		{http.MethodGet, apiV2Prefix + "/speakers", scopeRead, false},
+		{http.MethodPatch, apiV2Prefix + "/speakers/kitchen", scopeControl, false},
+		{http.MethodGet, apiV2Prefix + "/sources/active", scopeRead, false},
+		{http.MethodPut, apiV2Prefix + "/sources/active", scopeControl, true},
+		{http.MethodGet, apiV2Prefix + "/volume", scopeRead, false},
+		{http.MethodPut, apiV2Prefix + "/volume", scopeControl, true},
+		{http.MethodGet, apiV2Prefix + "/desired", scopeRead, false},
+		{http.MethodPut, apiV2Prefix + "/desired", scopeAdmin, true},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+
+			s, every := requiredScope(httptest.NewRequest(tt.method, tt.path, nil))
+
+			if s != tt.scope || every != tt.every {
+				t.Fatalf("got %s every=%v, want %s every=%v", s, every, tt.scope, tt.every)
+			}
+
+		})
+
+	}
+
+}
+
+func TestAuthenticateAuditsRejections(t *testing.T) {
+
+	prevAuth, prevAudit := auth, audit
+
+	defer func() {
+		auth, audit = prevAuth, prevAudit
+	}()
+
+	auth = authConfig{Tokens: []credential{
+		{Name: "kitchen-tablet", Token: "k", Scope: "control", Speakers: []string{"kitchen"}},
+		{Name: "house", Token: "h", Scope: "control"},
+	}}
+	audit = &auditLog{}
+
+	r := mux.NewRouter()
+	r.Use(Authenticate)
+	r.Use(Audit)
+	r.HandleFunc("/source/{id}", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, 200, "OK", "")
+	})
+
+	tests := []struct {
+		token     string
+		status    int
+		principal string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"wrong", http.StatusUnauthorized, ""},
+		//limited to one speaker, the source would change what every speaker plays
+		{"k", http.StatusForbidden, "kitchen-tablet"},
+		{"h", http.StatusOK, "house"},
+	}
+
+	for i, tt := range tests {
+
+		req := httptest.NewRequest(http.MethodGet, "/source/spotify", nil)
+
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Fatalf("token %q answered %d, want %d", tt.token, w.Code, tt.status)
+		}
+
+		entries, _ := audit.newest(100, nil)
+
+		if len(entries) != i+1 {
+			t.Fatalf("token %q left %d audit entries, want %d", tt.token, len(entries), i+1)
+		}
+
+		e := entries[0]
+
+		if e.Status != tt.status || e.Principal != tt.principal || e.Action != "GET /source/{id}" || e.Target != "spotify" {
+			t.Fatalf("token %q audited as %+v", tt.token, e)
+		}
+
+	}
+
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	client "github.com/rob121/airfoil-go"
+	"net/http"
+	"time"
+)
+
+const (
+	batchStopOnError = "stop_on_error"
+	batchBestEffort  = "best_effort"
+
+	maxBatchOps = 100
+	maxFade     = time.Minute
+
+	//a whole batch, waits and fades included, unless http.batch_timeout says otherwise
+	defaultBatchTimeout = 2 * time.Minute
+)
+
+// batchRequest is the body of POST /api/batch, Wait works like ?wait= for every operation
+type batchRequest struct {
+	Mode       string    `json:"mode,omitempty"`
+	Wait       string    `json:"wait,omitempty"`
+	Operations []batchOp `json:"operations"`
+}
+
+// batchOp is one step, Speaker and Source take anything the resolvers understand
+type batchOp struct {
+	Op       string   `json:"op"`
+	Speaker  string   `json:"speaker,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	Volume   *float64 `json:"volume,omitempty"`
+	Duration string   `json:"duration,omitempty"`
+}
+
+// batchResult is the outcome of one operation, status 0 when it was skipped after an earlier failure
+type batchResult struct {
+	Index  int         `json:"index"`
+	Op     string      `json:"op"`
+	Target string      `json:"target,omitempty"`
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// plannedOp is a checked operation with the speaker or source already resolved
+type plannedOp struct {
+	batchOp
+	id   string //speaker long identifier or source identifier
+	fade time.Duration
+}
+
+// POST /api/batch runs the operations in order. Everything is checked before the first one is sent,
+// so a typo can't leave the house half changed
+func httpBatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	var br batchRequest
+
+	if err := decodeBody(w, r, &br); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	if br.Mode == "" {
+		br.Mode = batchStopOnError
+	}
+
+	if br.Mode != batchStopOnError && br.Mode != batchBestEffort {
+		respondError(w, badRequest("mode must be %s or %s", batchStopOnError, batchBestEffort))
+		return
+	}
+
+	if len(br.Operations) == 0 || len(br.Operations) > maxBatchOps {
+		respondError(w, badRequest("send between 1 and %d operations", maxBatchOps))
+		return
+	}
+
+	wait, waiting := parseWait(br.Wait)
+
+	if qw, ok := waitTimeout(r); ok {
+		wait, waiting = qw, ok
+	}
+
+	plan := make([]plannedOp, len(br.Operations))
+
+	for i, op := range br.Operations {
+
+		p, err := planOp(r, op)
+
+		if err != nil {
+			respondError(w, fmt.Errorf("operation %d: %w", i, err))
+			return
+		}
+
+		plan[i] = p
+
+	}
+
+	results := make([]batchResult, len(plan))
+	failed, stopped := 0, false
+
+	//not the request context, a caller that goes away halfway shouldn't stop the batch. writeTimeout
+	//leaves batches alone, so this is what bounds one
+	timeout := serverDuration("http.batch_timeout", defaultBatchTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for i, p := range plan {
+
+		results[i] = batchResult{Index: i, Op: p.Op, Target: p.id}
+
+		if p.Op == "source" {
+			results[i].Target = p.Source
+		}
+
+		if stopped {
+			continue
+		}
+
+		//out of time, whatever the mode the rest is skipped
+		if ctx.Err() != nil {
+
+			failed++
+			results[i].Status = http.StatusGatewayTimeout
+			results[i].Error = fmt.Sprintf("batch took longer than %s", timeout)
+
+			stopped = true
+			continue
+
+		}
+
+		res, err := runOp(ctx, p, wait, waiting)
+
+		if err != nil {
+
+			failed++
+			results[i].Status = statusFor(err)
+			results[i].Error = err.Error()
+
+			stopped = br.Mode == batchStopOnError
+			continue
+
+		}
+
+		results[i].Status = http.StatusOK
+		results[i].Result = res
+
+	}
+
+	if failed > 0 {
+		respondStatus(w, firstFailure(results), fmt.Sprintf("%d of %d operations failed", failed, len(plan)), results)
+		return
+	}
+
+	respondStatus(w, http.StatusOK, "OK", results)
+
+}
+
+func planOp(r *http.Request, op batchOp) (plannedOp, error) {
+
+	p := plannedOp{batchOp: op}
+
+	switch op.Op {
+	case "connect", "disconnect", "volume", "fade":
+	case "source":
+		if op.Source == "" {
+			return p, badRequest("source is required")
+		}
+
+		if err := principalFrom(r).permits(scopeControl, true); err != nil {
+			return p, err
+		}
+
+		src, err := ca.ResolveSource(op.Source)
+
+		//like SelectSource, an app launched since the last fetch can be picked straight away
+		if errors.Is(err, client.ErrNotFound) {
+
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			defer cancel()
+
+			if rerr := ca.RefreshSources(ctx); rerr != nil {
+				return p, rerr
+			}
+
+			src, err = ca.ResolveSource(op.Source)
+
+		}
+
+		if err != nil {
+			return p, err
+		}
+
+		p.id = src.Identifier
+
+		return p, nil
+	default:
+		return p, badRequest("unknown op %q, use connect, disconnect, volume, fade or source", op.Op)
+	}
+
+	if op.Op == "volume" || op.Op == "fade" {
+
+		if op.Volume == nil {
+			return p, badRequest("volume must be between 0 and 1")
+		}
+
+		if err := checkVolume(*op.Volume); err != nil {
+			return p, err
+		}
+
+	}
+
+	if op.Op == "fade" {
+
+		d, err := time.ParseDuration(op.Duration)
+
+		if err != nil || d <= 0 || d > maxFade {
+			return p, badRequest("duration must be like 3s, at most %s", maxFade)
+		}
+
+		p.fade = d
+
+	}
+
+	spk, err := ca.ResolveSpeaker(op.Speaker)
+
+	if err != nil {
+		return p, err
+	}
+
+	if err := allowSpeaker(r, spk); err != nil {
+		return p, err
+	}
+
+	p.id = spk.LongIdentifier
+
+	return p, nil
+
+}
+
+// runOp runs one operation within ctx, the batch's deadline
+func runOp(ctx context.Context, p plannedOp, wait time.Duration, waiting bool) (interface{}, error) {
+
+	timeout := 10 * time.Second
+
+	if waiting {
+		timeout = wait
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout+p.fade)
+	defer cancel()
+
+	switch p.Op {
+	case "connect":
+		if waiting {
+			return nil, ca.ConnectAndWait(ctx, p.id)
+		}
+		return nil, ca.Connect(p.id)
+	case "disconnect":
+		if waiting {
+			return nil, ca.DisconnectAndWait(ctx, p.id)
+		}
+		return nil, ca.Disconnect(p.id)
+	case "volume":
+		if waiting {
+			return nil, ca.VolumeAndWait(ctx, p.id, *p.Volume)
+		}
+		return nil, ca.Volume(p.id, *p.Volume)
+	case "fade":
+		if waiting {
+			return nil, ca.FadeAndWait(ctx, p.id, *p.Volume, p.fade)
+		}
+		return nil, ca.Fade(ctx, p.id, *p.Volume, p.fade)
+	}
+
+	var src client.Source
+	var err error
+
+	if waiting {
+		src, err = ca.SelectSourceAndWait(ctx, p.id)
+	} else {
+		src, err = ca.SelectSource(ctx, p.id)
+	}
+
+	return src, err
+
+}
+
+func firstFailure(results []batchResult) int {
+
+	for _, res := range results {
+
+		if res.Status != 0 && res.Status != http.StatusOK {
+			return res.Status
+		}
+
+	}
+
+	return http.StatusInternalServerError
+
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	client "github.com/rob121/airfoil-go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlanOp(t *testing.T) {
+
+	sent, remote := pipeAirfoil(t,
+		client.Speaker{LongIdentifier: "DC9B9CEFC55C@Kitchen", Name: "Kitchen", Connected: true},
+		client.Speaker{LongIdentifier: "BEEF00112233@Office", Name: "Office", Connected: true},
+		client.Speaker{LongIdentifier: "112233445566@Living Room", Name: "Living Room"},
+		client.Speaker{LongIdentifier: "665544332211@Living Room", Name: "Living Room"},
+	)
+
+	answerSources(remote, sent, `[{"identifier":"com.spotify.client","friendlyName":"Spotify"}]`)
+
+	vol := func(v float64) *float64 { return &v }
+
+	everyone := &principal{name: "admin", scope: scopeAdmin}
+	kitchenOnly := &principal{name: "kitchen", scope: scopeControl, speakers: []string{"kitchen"}}
+
+	tests := []struct {
+		name   string
+		who    *principal
+		op     batchOp
+		status int //0 when the op is planned
+		id     string
+	}{
+		{name: "unknown op", op: batchOp{Op: "explode", Speaker: "kitchen"}, status: http.StatusBadRequest},
+		{name: "volume missing", op: batchOp{Op: "volume", Speaker: "kitchen"}, status: http.StatusBadRequest},
+		{name: "volume out of range", op: batchOp{Op: "volume", Speaker: "kitchen", Volume: vol(1.5)}, status: http.StatusBadRequest},
+		{name: "volume 0", op: batchOp{Op: "volume", Speaker: "kitchen", Volume: vol(0)}, id: "DC9B9CEFC55C@Kitchen"},
+		{name: "fade without duration", op: batchOp{Op: "fade", Speaker: "kitchen", Volume: vol(0.5), Duration: "soon"}, status: http.StatusBadRequest},
+		{name: "fade too long", op: batchOp{Op: "fade", Speaker: "kitchen", Volume: vol(0.5), Duration: "2m"}, status: http.StatusBadRequest},
+		{name: "fade", op: batchOp{Op: "fade", Speaker: "office", Volume: vol(0.5), Duration: "3s"}, id: "BEEF00112233@Office"},
+		{name: "unknown speaker", op: batchOp{Op: "connect", Speaker: "garage"}, status: http.StatusNotFound},
+		{name: "ambiguous speaker", op: batchOp{Op: "connect", Speaker: "living room"}, status: http.StatusConflict},
+		{name: "source missing", op: batchOp{Op: "source"}, status: http.StatusBadRequest},
+		{name: "mistyped source", op: batchOp{Op: "source", Source: "winamp"}, status: http.StatusNotFound},
+		{name: "source", op: batchOp{Op: "source", Source: "spotify"}, id: "com.spotify.client"},
+		{name: "limited to another speaker", who: kitchenOnly, op: batchOp{Op: "disconnect", Speaker: "office"}, status: http.StatusForbidden},
+		{name: "limited to the speaker", who: kitchenOnly, op: batchOp{Op: "disconnect", Speaker: "kitchen"}, id: "DC9B9CEFC55C@Kitchen"},
+		{name: "limited source", who: kitchenOnly, op: batchOp{Op: "source", Source: "spotify"}, status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			who := tt.who
+
+			if who == nil {
+				who = everyone
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/batch", nil)
+			r = r.WithContext(context.WithValue(r.Context(), authKey{}, who))
+
+			p, err := planOp(r, tt.op)
+
+			switch {
+			case tt.status != 0:
+				if err == nil || statusFor(err) != tt.status {
+					t.Fatalf("want %d, got %v", tt.status, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case p.id != tt.id:
+				t.Fatalf("planned %s, want %s", p.id, tt.id)
+			}
+
+		})
+
+	}
+
+}
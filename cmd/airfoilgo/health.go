@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	client "github.com/rob121/airfoil-go"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+var started = time.Now()
+
+// debugState is what /debug/state answers, Airfoil is nil until an instance was found
+type debugState struct {
+	Ready         bool           `json:"ready"`
+	Airfoil       *client.Health `json:"airfoil"`
+	MQTTConnected bool           `json:"mqttConnected"`
+	Started       time.Time      `json:"started"`
+	Goroutines    int            `json:"goroutines"`
+}
+
+// probes, the audit log, the history, the api description and the control panel answer whatever state
+// airfoil is in, so they skip Middleware
+func bypassReady(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/debug/state" || path == "/api/audit" || path == "/api/history" || path == "/openapi.json" || isUI(path)
+}
+
+// probes are left open so kubernetes and monitoring don't need a token
+func isProbe(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// GET /healthz, the process is up and serving
+func httpHealthzHandler(w http.ResponseWriter, r *http.Request) {
+
+	respondStatus(w, http.StatusOK, "OK", nil)
+
+}
+
+// GET /readyz, 503 with the reasons until the handshake is done, the subscription answered and
+// airfoil has been heard from recently
+func httpReadyzHandler(w http.ResponseWriter, r *http.Request) {
+
+	var reasons []string
+
+	if !ready_to_serve {
+		reasons = append(reasons, "airfoil not found yet")
+	} else {
+
+		h := ca.Health()
+
+		if h.State != client.StateReady {
+			reasons = append(reasons, fmt.Sprintf("connection is %s", h.State))
+		}
+
+		if !h.Subscribed {
+			reasons = append(reasons, "not subscribed")
+		}
+
+		if maxAge := maxFrameAge(); h.LastFrame.IsZero() || time.Since(h.LastFrame) > maxAge {
+			reasons = append(reasons, fmt.Sprintf("nothing from airfoil in the last %s", maxAge))
+		}
+
+	}
+
+	if len(reasons) > 0 {
+		respondStatus(w, http.StatusServiceUnavailable, "Not Ready", reasons)
+		return
+	}
+
+	respondStatus(w, http.StatusOK, "OK", nil)
+
+}
+
+// GET /debug/state, needs the admin scope when auth is on
+func httpDebugStateHandler(w http.ResponseWriter, r *http.Request) {
+
+	ds := debugState{
+		Ready:         ready_to_serve,
+		MQTTConnected: mc != nil && mc.IsConnected(),
+		Started:       started,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+
+	if ready_to_serve {
+		h := ca.Health()
+		ds.Airfoil = &h
+	}
+
+	respondStatus(w, http.StatusOK, "OK", ds)
+
+}
+
+// the heartbeat gets a reply every HeartbeatEvery, three missed ones and the data is stale
+func maxFrameAge() time.Duration {
+
+	def := 3 * ca.HeartbeatEvery
+
+	if def <= 0 {
+		def = 30 * time.Second
+	}
+
+	return serverDuration("health.max_frame_age", def)
+
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	client "github.com/rob121/airfoil-go"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// historyOption sizes the library's history and points its log at history.file, rotated like the audit log
+func historyOption() client.Option {
+
+	size := 1000
+
+	if conf.IsSet("history.size") {
+		size = conf.GetInt("history.size")
+	}
+
+	path := conf.GetString("history.file")
+
+	if path == "" {
+		return client.WithHistory(size, nil)
+	}
+
+	file, err := openRotating(path, int64(conf.GetInt("history.max_size_mb"))<<20, conf.GetInt("history.keep"))
+
+	if err != nil {
+		log.Fatalf("Unable to open history log %s", err)
+	}
+
+	return client.WithHistory(size, file)
+
+}
+
+// GET /api/history?speaker=&type=&since=&limit=, newest first. type takes event types, notification
+// names or the kinds event and notification, comma separated
+func httpHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+
+	hq := client.HistoryQuery{Limit: 100}
+
+	if v := q.Get("since"); v != "" {
+
+		since, err := parseSince(v)
+
+		if err != nil {
+			respondError(w, badRequest("since: %s", err))
+			return
+		}
+
+		hq.Since = since
+
+	}
+
+	if v := q.Get("limit"); v != "" {
+
+		n, err := strconv.Atoi(v)
+
+		if err != nil || n < 1 {
+			respondError(w, badRequest("limit must be a positive number"))
+			return
+		}
+
+		hq.Limit = n
+
+	}
+
+	for _, v := range q["type"] {
+
+		for _, t := range strings.Split(v, ",") {
+
+			if t = strings.TrimSpace(t); t != "" {
+				hq.Types = append(hq.Types, t)
+			}
+
+		}
+
+	}
+
+	if ca == nil {
+		respondStatus(w, http.StatusOK, "OK", []client.HistoryEntry{})
+		return
+	}
+
+	//a speaker that has since gone from the list is still looked for by what was asked
+	if v := q.Get("speaker"); v != "" {
+
+		hq.Speaker = v
+
+		if spk, err := ca.ResolveSpeaker(v); err == nil {
+			hq.Speaker = spk.LongIdentifier
+		}
+
+	}
+
+	respondStatus(w, http.StatusOK, "OK", ca.History(hq))
+
+}
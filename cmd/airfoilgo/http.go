@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	client "github.com/rob121/airfoil-go"
+	"github.com/rob121/airfoil-go/apiclient"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,9 +22,36 @@ type JsonResp struct {
 	Message string      `json:"message"`
 }
 
-func startHTTPServer() {
+// apiRoutes is the part of /api outside v2, paths are full. /openapi.json describes these too
+func apiRoutes() []apiRoute {
+
+	return []apiRoute{
+		{Method: http.MethodPost, Path: "/api/batch", Summary: "Run several operations in order, all checked before the first is sent", Handler: httpBatchHandler, Body: batchRequest{}, Result: []batchResult{}, Query: []apiParam{waitParam}},
+		{Method: http.MethodGet, Path: "/api/audit", Summary: "Commands that changed something or were turned away, newest first", Handler: httpAuditHandler, Result: []auditEntry{}, Query: []apiParam{
+			{Name: "since", Type: "string", Description: "RFC 3339 time or a duration back from now, like 1h"},
+			{Name: "until", Type: "string", Description: "RFC 3339 time or a duration back from now"},
+			{Name: "origin", Type: "string", Description: "http, websocket, mqtt or reconciler"},
+			{Name: "action", Type: "string", Description: "substring of the action"},
+			{Name: "target", Type: "string", Description: "the target as recorded, or a speaker by anything {id} accepts"},
+			{Name: "principal", Type: "string", Description: "token or user name"},
+			{Name: "limit", Type: "integer", Description: "at most this many entries, 100 by default"},
+		}},
+		{Method: http.MethodGet, Path: "/api/history", Summary: "Notifications from airfoil and the events they caused, newest first", Handler: httpHistoryHandler, Result: []client.HistoryEntry{}, Query: []apiParam{
+			{Name: "speaker", Type: "string", Description: "anything {id} accepts, a speaker no longer listed is matched by what was asked"},
+			{Name: "type", Type: "string", Description: "event types, notification names, event or notification, comma separated"},
+			{Name: "since", Type: "string", Description: "RFC 3339 time or a duration back from now, like 24h"},
+			{Name: "limit", Type: "integer", Description: "at most this many entries, 100 by default"},
+		}},
+	}
+
+}
+
+// newRouter has every route behind the auth, audit and readiness middleware
+func newRouter() *mux.Router {
 
 	r := mux.NewRouter()
+	r.Use(Authenticate)
+	r.Use(Audit)
 	r.Use(Middleware)
 	r.HandleFunc("/", httpDefaultHandler)
 	r.HandleFunc("/airfoils", httpAirfoilsHandler)
@@ -28,33 +59,98 @@ func startHTTPServer() {
 	r.HandleFunc("/toggleconn/{id}", httpToggleconnHandler)
 	r.HandleFunc("/source/{id}", httpSourceHandler)
 	r.HandleFunc("/volume/{id}/{vol}", httpVolumeHandler)
+	r.HandleFunc("/mastervolume", httpMasterVolumeHandler)
+	r.HandleFunc("/mastervolume/adjust/{delta}", httpMasterVolumeAdjustHandler)
+	r.HandleFunc("/mastervolume/{vol}", httpMasterVolumeHandler)
 	r.HandleFunc("/disconnect/{id}", httpDisconnectHandler)
 	r.HandleFunc("/speakers", httpSpeakersHandler)
+	r.HandleFunc("/snapshot", httpSnapshotHandler)
 	r.HandleFunc("/sources", httpSourcesHandler)
+	r.HandleFunc("/desired", httpDesiredHandler)
+	r.HandleFunc("/metrics", httpMetricsHandler)
+	r.HandleFunc("/heartbeat", httpHeartbeatHandler)
+	r.HandleFunc("/events", httpEventsHandler)
+	r.HandleFunc("/ws", httpWebsocketHandler)
+	r.HandleFunc("/openapi.json", httpOpenAPIHandler)
+	r.HandleFunc("/healthz", httpHealthzHandler)
+	r.HandleFunc("/readyz", httpReadyzHandler)
+	r.HandleFunc("/debug/state", httpDebugStateHandler)
+	r.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	r.PathPrefix("/ui/").Handler(uiHandler())
+
+	for _, rt := range apiRoutes() {
+		r.HandleFunc(rt.Path, rt.Handler).Methods(rt.Method)
+	}
+
+	registerV2(r.PathPrefix(apiV2Prefix).Subrouter())
+
+	return r
+
+}
+
+func startHTTPServer() {
+
+	loadAuth()
+
+	r := newRouter()
 	http.Handle("/", r)
 
+	loadCORS()
+
+	tlsConf, err := serverTLS()
+
+	if err != nil {
+		log.Fatalf("Unable to set up TLS %s", err)
+	}
+
 	srv := &http.Server{
-		Handler: r,
-		Addr:    fmt.Sprintf(":%s", conf.GetString("port")),
+		Handler: CORS(writeTimeout(r, serverDuration("http.write_timeout", 15*time.Second))),
+		Addr:    listenAddr(),
 		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		// the write timeout is per handler, a server wide one would cut the event streams off
+		ReadTimeout:       serverDuration("http.read_timeout", 15*time.Second),
+		ReadHeaderTimeout: serverDuration("http.read_header_timeout", 5*time.Second),
+		IdleTimeout:       serverDuration("http.idle_timeout", 60*time.Second),
+		TLSConfig:         tlsConf,
+	}
+
+	if tlsConf != nil {
+		fmt.Printf("Listening on https://%s\n", srv.Addr)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
 	}
 
-	fmt.Println("Listening on port", conf.GetString("port"))
+	fmt.Printf("Listening on http://%s\n", srv.Addr)
 	log.Fatal(srv.ListenAndServe())
 }
 
 func Middleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		if bypassReady(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		//the /api routes get real status codes, the old routes always answered 200
+		notReady := func(msg string) {
+
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				respondStatus(w, http.StatusServiceUnavailable, "Error", msg)
+				return
+			}
+
+			respond(w, 500, "Error", msg)
+
+		}
+
 		if !ready_to_serve {
-			respond(w, 500, "Error", "Not Ready")
+			notReady("Not Ready")
 			return
 		}
 
-		if ca.Status < 2 {
-			respond(w, 500, "Error", "Connection Not Ready")
+		//streams report the connection state themselves
+		if ca.State() < client.StateHandshake && !isStream(r.URL.Path) {
+			notReady("Connection Not Ready")
 			return
 		}
 
@@ -62,22 +158,36 @@ func Middleware(h http.Handler) http.Handler {
 	})
 }
 
-func httpVolumeHandler(w http.ResponseWriter, r *http.Request) {
+// writeTimeout bounds every handler except the long lived streams and batches, which wait and fade
+// one operation after the other
+func writeTimeout(h http.Handler, d time.Duration) http.Handler {
 
-	vars := mux.Vars(r)
+	bounded := http.TimeoutHandler(h, d, `{"code":503,"payload":null,"message":"Timeout"}`)
 
-	id := vars["id"]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-	vol := vars["vol"]
+		if isStream(r.URL.Path) || r.URL.Path == "/api/batch" {
+			h.ServeHTTP(w, r)
+			return
+		}
 
-	if strings.Contains(vol, ".") {
+		bounded.ServeHTTP(w, r)
 
-		parts := strings.Split(vol, ".")
-		vol = parts[0]
+	})
 
-	}
+}
+
+func isStream(path string) bool {
+	return path == "/events" || path == "/ws"
+}
+
+func httpVolumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	id := vars["id"]
 
-	voli, _ := strconv.Atoi(vol)
+	vol := vars["vol"]
 
 	log.Printf("Got Volume %s for %s", vol, id)
 
@@ -88,22 +198,93 @@ func httpVolumeHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if len(vol) < 1 || voli > 100 || voli < 1 {
-		voli = 1
+	volf, verr := percentVolume(vol)
+
+	if verr != nil {
+
+		respond(w, 500, "Error", "Invalid Volume")
+		return
+
 	}
 
 	log.Printf("Getting Speaker %s", id)
-	spk, err := ca.GetSpeaker(id)
-	log.Printf("Got Speaker %s", id)
+	spk, err := ca.ResolveSpeaker(id)
+	log.Printf("Got Speaker %s", spk.LongIdentifier)
 
 	if err != nil {
 		respond(w, 500, "Error", err.Error())
 		return
 	}
 
-	volf := float64(voli) / 100
+	if aerr := allowSpeaker(r, spk); aerr != nil {
+		respondError(w, aerr)
+		return
+	}
 
-	status := ca.Volume(spk.LongIdentifier, volf)
+	status := confirm(r, func() error {
+		return ca.Volume(spk.LongIdentifier, volf)
+	}, func(ctx context.Context) error {
+		return ca.VolumeAndWait(ctx, spk.LongIdentifier, volf)
+	})
+
+	if status != nil {
+		respond(w, 500, "Error", status.Error())
+		return
+	}
+
+	respond(w, 200, "OK", "")
+
+}
+
+func httpMasterVolumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	vol, ok := vars["vol"]
+
+	if !ok {
+
+		respond(w, 200, "OK", ca.MasterVolume())
+		return
+
+	}
+
+	log.Printf("Got Master Volume %s", vol)
+
+	volf, verr := percentVolume(vol)
+
+	if verr != nil {
+
+		respond(w, 500, "Error", "Invalid Volume")
+		return
+
+	}
+
+	status := ca.SetMasterVolume(volf)
+
+	if status != nil {
+		respond(w, 500, "Error", status.Error())
+		return
+	}
+
+	respond(w, 200, "OK", "")
+
+}
+
+func httpMasterVolumeAdjustHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	delta, err := strconv.Atoi(vars["delta"])
+
+	if err != nil || delta > 100 || delta < -100 {
+
+		respond(w, 500, "Error", "Invalid Delta")
+		return
+
+	}
+
+	status := ca.AdjustMasterVolume(float64(delta) / 100)
 
 	if status != nil {
 		respond(w, 500, "Error", status.Error())
@@ -127,24 +308,33 @@ func httpConnectHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	for _, s := range ca.Speakers {
+	spk, err := ca.ResolveSpeaker(id)
+
+	if err == nil {
 
-		if id == s.LongIdentifier {
-			resp := ca.Connect(id)
+		if aerr := allowSpeaker(r, spk); aerr != nil {
+			respondError(w, aerr)
+			return
+		}
 
-			if resp == nil {
-				respond(w, 200, "OK", "")
-			} else {
+		resp := confirm(r, func() error {
+			return ca.Connect(spk.LongIdentifier)
+		}, func(ctx context.Context) error {
+			return ca.ConnectAndWait(ctx, spk.LongIdentifier)
+		})
 
-				respond(w, 500, fmt.Sprintf("ERR: %s", resp), "")
-			}
+		if resp == nil {
+			respond(w, 200, "OK", "")
+		} else {
 
-			return
+			respond(w, 500, fmt.Sprintf("ERR: %s", resp), "")
 		}
 
+		return
+
 	}
 
-	respond(w, 500, "Error", "Id Mismatch")
+	respond(w, 500, "Error", idError(err))
 	return
 
 }
@@ -162,19 +352,24 @@ func httpToggleconnHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	spk, err := ca.GetSpeaker(id)
+	spk, err := ca.ResolveSpeaker(id)
 
 	var resp error
 
 	if err == nil {
 
+		if aerr := allowSpeaker(r, spk); aerr != nil {
+			respondError(w, aerr)
+			return
+		}
+
 		if spk.Connected == true {
 
-			resp = ca.Disconnect(id)
+			resp = ca.Disconnect(spk.LongIdentifier)
 
 		} else {
 
-			resp = ca.Connect(id)
+			resp = ca.Connect(spk.LongIdentifier)
 
 		}
 
@@ -189,7 +384,7 @@ func httpToggleconnHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	respond(w, 500, "Error", "Id Mismatch")
+	respond(w, 500, "Error", idError(err))
 	return
 
 }
@@ -202,13 +397,32 @@ func httpSourceHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(id) < 1 {
 
-		respond(w, 500, fmt.Sprintf("ERR:Id Not Found"), "")
+		respond(w, 500, "Error", "Invalid Id")
+		return
 
 	}
 
-	resp := ca.SetSource(id)
+	var src client.Source
+
+	err := confirm(r, func() (err error) {
+		src, err = ca.SelectSource(r.Context(), id)
+		return err
+	}, func(ctx context.Context) (err error) {
+		src, err = ca.SelectSourceAndWait(ctx, id)
+		return err
+	})
+
+	if err == nil {
+		respond(w, 200, "OK", src)
+		return
+	}
+
+	if src.Identifier == "" {
+		respond(w, 500, "Error", idError(err))
+		return
+	}
 
-	respond(w, 200, "OK", resp)
+	respond(w, 500, fmt.Sprintf("ERR: %s", err), "")
 
 }
 
@@ -225,31 +439,40 @@ func httpDisconnectHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	for _, s := range ca.Speakers {
+	spk, err := ca.ResolveSpeaker(id)
 
-		if id == s.LongIdentifier {
-			resp := ca.Disconnect(id)
+	if err == nil {
 
-			if resp == nil {
+		if aerr := allowSpeaker(r, spk); aerr != nil {
+			respondError(w, aerr)
+			return
+		}
 
-				respond(w, 200, "OK", "")
+		resp := confirm(r, func() error {
+			return ca.Disconnect(spk.LongIdentifier)
+		}, func(ctx context.Context) error {
+			return ca.DisconnectAndWait(ctx, spk.LongIdentifier)
+		})
 
-			} else {
+		if resp == nil {
 
-				respond(w, 500, fmt.Sprintf("ERR: %s", resp), "")
-			}
-			return
+			respond(w, 200, "OK", "")
+
+		} else {
+
+			respond(w, 500, fmt.Sprintf("ERR: %s", resp), "")
 		}
+		return
 
 	}
 
-	respond(w, 500, "Error", "Id Mismatch")
+	respond(w, 500, "Error", idError(err))
 	return
 
 }
 
 func httpDefaultHandler(w http.ResponseWriter, r *http.Request) {
-	respond(w, 200, "OK", ca)
+	respond(w, 200, "OK", ca.Snapshot())
 }
 
 func httpAirfoilsHandler(w http.ResponseWriter, r *http.Request) {
@@ -259,18 +482,220 @@ func httpAirfoilsHandler(w http.ResponseWriter, r *http.Request) {
 func httpSourcesHandler(w http.ResponseWriter, r *http.Request) {
 
 	ca.FetchSources()
-	respond(w, 200, "OK", ca.Sources)
+
+	//?grouped=1 keeps airfoil's categories and order
+	if g := r.URL.Query().Get("grouped"); g != "" && g != "0" && g != "false" {
+		respond(w, 200, "OK", ca.Catalog())
+		return
+	}
+
+	respond(w, 200, "OK", ca.Sources())
+
+}
+
+func httpSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	respond(w, 200, "OK", ca.Snapshot())
 
 }
 
 func httpSpeakersHandler(w http.ResponseWriter, r *http.Request) {
 
-	respond(w, 200, "OK", ca.Speakers)
+	respond(w, 200, "OK", ca.Speakers())
+
+}
+
+func httpDesiredHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+
+		var ds client.DesiredState
+
+		if err := json.NewDecoder(r.Body).Decode(&ds); err != nil {
+			respond(w, 500, "Error", fmt.Sprintf("Invalid Desired State: %s", err))
+			return
+		}
+
+		resolved, err := resolveDesired(ds)
+
+		var ke *desiredKeyError
+
+		if errors.As(err, &ke) {
+			respond(w, 500, "Error", fmt.Sprintf("%s: %s", ke.Key, idError(ke.Err)))
+			return
+		}
+
+		rc.SetDesired(resolved)
+
+	}
+
+	respond(w, 200, "OK", rc.Desired())
+
+}
+
+// desiredKeyError names the desired state key that didn't resolve to a speaker
+type desiredKeyError struct {
+	Key string
+	Err error
+}
+
+func (e *desiredKeyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err)
+}
+
+func (e *desiredKeyError) Unwrap() error {
+	return e.Err
+}
+
+// keys can be anything the resolver understands, the reconciler wants long identifiers
+func resolveDesired(ds client.DesiredState) (client.DesiredState, error) {
+
+	resolved := make(map[string]client.DesiredSpeaker)
+
+	for id, want := range ds.Speakers {
+
+		spk, err := ca.ResolveSpeaker(id)
+
+		if err != nil {
+			return ds, &desiredKeyError{Key: id, Err: err}
+		}
+
+		resolved[spk.LongIdentifier] = want
+	}
+
+	ds.Speakers = resolved
+
+	return ds, nil
+
+}
+
+func httpHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+
+	respond(w, 200, "OK", heartbeatStatus())
+
+}
+
+func heartbeatStatus() apiclient.Heartbeat {
+
+	hb := ca.Heartbeat()
+
+	return apiclient.Heartbeat{
+		RTTMs:     float64(hb.RTT) / float64(time.Millisecond),
+		LastReply: hb.LastReply,
+		Missed:    hb.Missed,
+		Redials:   hb.Redials,
+	}
+
+}
+
+// prometheus text format
+func httpMetricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	metrics := ca.Metrics()
+
+	var names []string
+
+	for name := range metrics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	w.Header().Set("Content-type", "text/plain; version=0.0.4")
+
+	for _, name := range names {
+		fmt.Fprintf(w, "airfoil_%s %g\n", name, metrics[name])
+	}
+
+}
+
+// ambiguous lookups list their candidates, anything else keeps the old message
+func idError(err error) string {
+
+	var amb *client.AmbiguousError
+
+	if errors.As(err, &amb) {
+		return amb.Error()
+	}
+
+	return "Id Mismatch"
+
+}
+
+// confirm sends the command, with ?wait=1 (or ?wait=5s) it holds the response until airfoil confirms the change
+func confirm(r *http.Request, send func() error, sendAndWait func(ctx context.Context) error) error {
+
+	timeout, ok := waitTimeout(r)
+
+	if !ok {
+		return send()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	return sendAndWait(ctx)
+
+}
+
+// waitTimeout reads ?wait=, false when the caller doesn't want to wait
+func waitTimeout(r *http.Request) (time.Duration, bool) {
+
+	return parseWait(r.URL.Query().Get("wait"))
+
+}
+
+// percentVolume reads the 0-100 the old routes take, anything after a decimal point is dropped
+func percentVolume(vol string) (float64, error) {
+
+	if strings.Contains(vol, ".") {
+		vol = strings.Split(vol, ".")[0]
+	}
+
+	voli, err := strconv.Atoi(vol)
+
+	if err != nil {
+		return 0, badRequest("volume must be a number from 0 to 100")
+	}
+
+	volf := float64(voli) / 100
+
+	return volf, checkVolume(volf)
+
+}
+
+// parseWait takes 1 or a duration up to 10s, anything it can't read waits the full 10s
+func parseWait(wait string) (time.Duration, bool) {
+
+	if wait == "" || wait == "0" || wait == "false" {
+		return 0, false
+	}
+
+	timeout, err := time.ParseDuration(wait)
+
+	if err != nil || timeout <= 0 || timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+
+	return timeout, true
 
 }
 
 func respond(w http.ResponseWriter, code int, message string, payload interface{}) {
 
+	writeResp(w, http.StatusOK, code, message, payload)
+
+}
+
+// respondStatus also sends code as the http status, the legacy routes answer 200 whatever happened
+func respondStatus(w http.ResponseWriter, code int, message string, payload interface{}) {
+
+	writeResp(w, code, code, message, payload)
+
+}
+
+func writeResp(w http.ResponseWriter, status int, code int, message string, payload interface{}) {
+
 	resp := JsonResp{
 		Code:    code,
 		Payload: payload,
@@ -285,6 +710,7 @@ func respond(w http.ResponseWriter, code int, message string, payload interface{
 	}
 
 	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
 
 	fmt.Fprintln(w, string(jsonData))
 
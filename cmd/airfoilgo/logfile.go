@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile appends json lines to path, it is moved to path.1, path.2 ... once it reaches maxSize
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openRotating defaults maxSize to 10MB and keep to 5
+func openRotating(path string, maxSize int64, keep int) (*rotatingFile, error) {
+
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+
+	if keep <= 0 {
+		keep = 5
+	}
+
+	rf := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+
+	return rf, rf.open()
+
+}
+
+func (rf *rotatingFile) open() error {
+
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f, rf.size = f, fi.Size()
+
+	return nil
+
+}
+
+// Write takes one whole line, it never ends up split over two files
+func (rf *rotatingFile) Write(line []byte) (int, error) {
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size+int64(len(line)) > rf.maxSize {
+
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate: %w", err)
+		}
+
+	}
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	n, err := rf.f.Write(line)
+	rf.size += int64(n)
+
+	return n, err
+
+}
+
+// rotate shifts path.1 to path.2 and so on, the oldest beyond keep is dropped
+func (rf *rotatingFile) rotate() error {
+
+	if rf.f != nil {
+		rf.f.Close()
+		rf.f = nil
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+
+	for i := rf.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return rf.open()
+
+}
+
+// files is every file still kept, oldest first
+func (rf *rotatingFile) files() []string {
+
+	var out []string
+
+	for i := rf.keep; i >= 1; i-- {
+		out = append(out, fmt.Sprintf("%s.%d", rf.path, i))
+	}
+
+	return append(out, rf.path)
+
+}
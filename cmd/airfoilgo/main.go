@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"github.com/spf13/viper"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +20,7 @@ import (
 var conf *viper.Viper
 var cerr error
 var ca *client.AirfoilConn
+var rc *client.Reconciler
 var ready_to_serve bool = false
 var mc mqtt.Client
 var debug bool = false
@@ -41,6 +44,8 @@ func main() {
 		log.Fatalf("Unable to load configuration %s", cerr)
 	}
 
+	loadAudit()
+
 	go startHTTPServer()
 
 	mc = mqttClient()
@@ -63,7 +68,41 @@ func main() {
 
 	fmt.Printf("Found Airfoil at %s\n", addr)
 
-	ca = client.NewConn(addr)
+	var opts []client.Option
+
+	if conf.IsSet("notifications") {
+		opts = append(opts, client.WithNotifications(conf.GetStringSlice("notifications")))
+	}
+
+	if conf.IsSet("aliases") {
+		opts = append(opts, client.WithSpeakerAliases(conf.GetStringMapString("aliases")))
+	}
+
+	if conf.IsSet("source_aliases") {
+		opts = append(opts, client.WithSourceAliases(conf.GetStringMapString("source_aliases")))
+	}
+
+	if conf.IsSet("airfoil.dial_timeout") {
+		opts = append(opts, client.WithDialTimeout(conf.GetDuration("airfoil.dial_timeout")))
+	}
+
+	if conf.IsSet("airfoil.icon_size") {
+		opts = append(opts, client.WithSourceIcons(conf.GetInt("airfoil.icon_size"), 1))
+	}
+
+	opts = append(opts, historyOption())
+
+	ca = client.NewConn(addr, opts...)
+
+	state_file := conf.GetString("state_file")
+
+	if state_file == "" {
+		state_file = "state.json"
+	}
+
+	if serr := ca.SetStore(client.NewFileStore(state_file)); serr != nil {
+		log.Printf("Unable to load state from %s: %s\n", state_file, serr)
+	}
 
 	derr := ca.Dial()
 
@@ -74,12 +113,61 @@ func main() {
 		return
 	}
 
+	rc = client.NewReconciler(ca)
+
+	auditReconciler()
+
+	if conf.IsSet("desired") {
+
+		var ds client.DesiredState
+
+		if uerr := conf.UnmarshalKey("desired", &ds); uerr != nil {
+			log.Printf("Invalid desired state %s\n", uerr)
+		} else {
+			rc.SetDesired(ds)
+		}
+
+	}
+
 	ready_to_serve = true
 
+	go rc.Run(context.Background())
 	go ca.KeepAlive()
 	go fetchData()
 	go syncSpeakers()
 
+	//keep home assistant in step with speakers coming and going
+
+	ca.Listen(func(ev client.Event) {
+
+		switch ev.Type {
+
+		case client.EventSpeakerAdded:
+
+			publishMediaPlayer(ev.Data.(client.Speaker), mc)
+
+		case client.EventSpeakerRemoved:
+
+			unpublishMediaPlayer(ev.Data.(client.Speaker), mc)
+
+		case client.EventSpeakerRenamed:
+
+			rn := ev.Data.(client.SpeakerRename)
+
+			if client.IDSlug(rn.OldID) != client.IDSlug(rn.Speaker.LongIdentifier) {
+				unpublishMediaPlayer(client.Speaker{LongIdentifier: rn.OldID, Name: rn.OldName}, mc)
+			}
+
+			publishMediaPlayer(rn.Speaker, mc)
+
+		case client.EventActiveSourceChanged:
+
+			publishActiveSource()
+
+		}
+
+	})
+
 	//handle messages back from airfoil and do custom actions
 
 	ca.Reader(func(response client.AirfoilResponse, err error) {
@@ -97,6 +185,8 @@ func main() {
 				publishPlayerState(spk, mc)
 			}
 
+			publishMasterVolume(mc)
+
 		}
 
 		if response.ReplyID == "13" {
@@ -120,22 +210,6 @@ func main() {
 	select {}
 }
 
-func cleanSpeakerName(spk string) string {
-
-	s := ""
-
-	parts := strings.Split(spk, "@")
-
-	if len(parts) > 1 {
-		s = parts[1]
-	} else {
-		s = spk
-	}
-
-	return strings.ToLower(strings.Replace(s, " ", "_", -1)) //strings.Replace("b’", "", strings.Replace(strings.Replace(spk, " ", "_", -1), "'", "", -1), -1))
-
-}
-
 func publishSources() {
 
 	if debug {
@@ -146,7 +220,7 @@ func publishSources() {
 
 	var out []client.Source
 
-	for _, src := range ca.Sources {
+	for _, src := range ca.Catalog().All() {
 
 		src.Icon = "" //too much data
 
@@ -166,9 +240,15 @@ func publishSources() {
 		mc.Publish(state_topic, 0, false, string(out2))
 	}
 
-	topic2 := fmt.Sprintf("home/speakers/airfoil/source")
+	publishActiveSource()
+
+}
+
+func publishActiveSource() {
+
+	topic := fmt.Sprintf("home/speakers/airfoil/source")
 
-	mc.Publish(topic2, 0, false, ca.ActiveSourceKey)
+	mc.Publish(topic, 0, false, ca.ActiveSource().Identifier)
 
 }
 
@@ -178,7 +258,7 @@ func publishPlayerState(spk *client.Speaker, mc mqtt.Client) {
 		fmt.Println("MQTT Publish Player State")
 	}
 
-	state_topic := fmt.Sprintf("home/speakers/airfoil/%s", cleanSpeakerName(spk.LongIdentifier))
+	state_topic := fmt.Sprintf("home/speakers/airfoil/%s", client.IDSlug(spk.LongIdentifier))
 
 	out := make(map[string]interface{})
 
@@ -211,16 +291,16 @@ func publishMediaPlayer(spk client.Speaker, mc mqtt.Client) {
 
 	//shared state topic with json
 
-	state_topic := fmt.Sprintf("home/speakers/airfoil/%s", cleanSpeakerName(spk.LongIdentifier))
+	state_topic := fmt.Sprintf("home/speakers/airfoil/%s", client.IDSlug(spk.LongIdentifier))
 
 	//publish config for each sensor
 
-	topic := fmt.Sprintf("homeassistant/sensor/airfoil_%s_connected/config", cleanSpeakerName(spk.LongIdentifier))
+	topic := fmt.Sprintf("homeassistant/sensor/airfoil_%s_connected/config", client.IDSlug(spk.LongIdentifier))
 
 	out := make(map[string]interface{})
 
-	out["name"] = fmt.Sprintf("airfoil_%s_connected", cleanSpeakerName(spk.LongIdentifier))
-	out["unique_id"] = fmt.Sprintf("airfoil_%s_connected", cleanSpeakerName(spk.LongIdentifier))
+	out["name"] = fmt.Sprintf("airfoil_%s_connected", client.IDSlug(spk.LongIdentifier))
+	out["unique_id"] = fmt.Sprintf("airfoil_%s_connected", client.IDSlug(spk.LongIdentifier))
 	out["friendly_name"] = fmt.Sprintf("%s Connected", spk.Name)
 	out["state_topic"] = state_topic
 	out["value_template"] = "{{ value_json.connected }}"
@@ -239,12 +319,12 @@ func publishMediaPlayer(spk client.Speaker, mc mqtt.Client) {
 
 	//config for volume
 
-	topic2 := fmt.Sprintf("homeassistant/sensor/airfoil_%s_volume/config", cleanSpeakerName(spk.LongIdentifier))
+	topic2 := fmt.Sprintf("homeassistant/sensor/airfoil_%s_volume/config", client.IDSlug(spk.LongIdentifier))
 
 	out2 := make(map[string]interface{})
 
-	out2["name"] = fmt.Sprintf("airfoil_%s_volume", cleanSpeakerName(spk.LongIdentifier))
-	out2["unique_id"] = fmt.Sprintf("airfoil_%s_volume", cleanSpeakerName(spk.LongIdentifier))
+	out2["name"] = fmt.Sprintf("airfoil_%s_volume", client.IDSlug(spk.LongIdentifier))
+	out2["unique_id"] = fmt.Sprintf("airfoil_%s_volume", client.IDSlug(spk.LongIdentifier))
 	out2["friendly_name"] = fmt.Sprintf("%s Volume", spk.Name)
 	out2["state_topic"] = state_topic
 	out2["value_template"] = "{{ value_json.volume_level }}"
@@ -255,12 +335,12 @@ func publishMediaPlayer(spk client.Speaker, mc mqtt.Client) {
 
 	mc.Publish(topic2, 0, false, string(out2j))
 
-	topic3 := fmt.Sprintf("homeassistant/sensor/airfoil_%s_id/config", cleanSpeakerName(spk.LongIdentifier))
+	topic3 := fmt.Sprintf("homeassistant/sensor/airfoil_%s_id/config", client.IDSlug(spk.LongIdentifier))
 
 	out3 := make(map[string]interface{})
 
-	out3["name"] = fmt.Sprintf("airfoil_%s_id", cleanSpeakerName(spk.LongIdentifier))
-	out3["unique_id"] = fmt.Sprintf("airfoil_%s_id", cleanSpeakerName(spk.LongIdentifier))
+	out3["name"] = fmt.Sprintf("airfoil_%s_id", client.IDSlug(spk.LongIdentifier))
+	out3["unique_id"] = fmt.Sprintf("airfoil_%s_id", client.IDSlug(spk.LongIdentifier))
 	out3["friendly_name"] = fmt.Sprintf("%s ID", spk.Name)
 	out3["state_topic"] = state_topic
 	out3["value_template"] = "{{ value_json.id }}"
@@ -302,8 +382,202 @@ func publishMediaPlayer(spk client.Speaker, mc mqtt.Client) {
 
 	mc.Publish(topic5, 0, false, string(out5s))
 
+	topic6 := fmt.Sprintf("homeassistant/number/airfoil_master_volume/config")
+
+	out6 := make(map[string]interface{})
+
+	out6["name"] = fmt.Sprintf("airfoil_master_volume")
+	out6["unique_id"] = fmt.Sprintf("airfoil_master_volume")
+	out6["friendly_name"] = fmt.Sprintf("Airfoil Master Volume")
+	out6["state_topic"] = fmt.Sprintf("home/speakers/airfoil/master_volume")
+	out6["command_topic"] = fmt.Sprintf("home/speakers/airfoil/master_volume/set")
+	out6["value_template"] = "{{ (value_json.volume_level * 100) | round(0) }}"
+	out6["min"] = 0
+	out6["max"] = 100
+	out6["step"] = 1
+	out6["qos"] = 0
+	out6["retain"] = false
+
+	out6s, _ := json.Marshal(out6)
+
+	mc.Publish(topic6, 0, false, string(out6s))
+
 	go publishPlayerState(&spk, mc)
 	go publishSources()
+	go publishMasterVolume(mc)
+
+}
+
+// an empty retained config removes the entity from home assistant
+func unpublishMediaPlayer(spk client.Speaker, mc mqtt.Client) {
+
+	if debug {
+		fmt.Println("MQTT Remove Config")
+	}
+
+	for _, sensor := range []string{"connected", "volume", "id"} {
+
+		topic := fmt.Sprintf("homeassistant/sensor/airfoil_%s_%s/config", client.IDSlug(spk.LongIdentifier), sensor)
+
+		if debug {
+			fmt.Println("Clearing topic", topic)
+		}
+
+		mc.Publish(topic, 0, true, "")
+
+	}
+
+}
+
+func publishMasterVolume(mc mqtt.Client) {
+
+	if debug {
+		fmt.Println("MQTT Publish Master Volume")
+	}
+
+	state_topic := fmt.Sprintf("home/speakers/airfoil/master_volume")
+
+	out := make(map[string]interface{})
+
+	out["volume_level"] = ca.MasterVolume()
+
+	out2, _ := json.Marshal(out)
+
+	if debug {
+		fmt.Println("Sending to topic", state_topic)
+		fmt.Println(string(out2))
+	}
+
+	mc.Publish(state_topic, 0, false, string(out2))
+
+}
+
+// home assistant sends the number entity value as 0-100
+var masterVolumeHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+
+	if ca == nil {
+		return
+	}
+
+	e := auditEntry{Origin: auditOriginMQTT, Topic: msg.Topic(), Action: "mastervolume", Params: string(msg.Payload())}
+
+	vol, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Payload())), 64)
+
+	if err != nil {
+		log.Printf("Invalid master volume %s\n", msg.Payload())
+		auditCommand(e, badRequest("invalid master volume"))
+		return
+	}
+
+	if verr := checkVolume(vol / 100); verr != nil {
+		log.Printf("Invalid master volume %s\n", msg.Payload())
+		auditCommand(e, verr)
+		return
+	}
+
+	serr := ca.SetMasterVolume(vol / 100)
+
+	if serr != nil {
+		log.Printf("Master Volume Error %s\n", serr)
+	}
+
+	auditCommand(e, serr)
+
+}
+
+// payload is a source name, type, bundle id, alias or identifier
+var sourceSetHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+
+	if ca == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := strings.TrimSpace(string(msg.Payload()))
+
+	_, err := ca.SelectSource(ctx, query)
+
+	if err != nil {
+		log.Printf("MQTT Source %s: %s\n", query, err)
+	}
+
+	auditCommand(auditEntry{Origin: auditOriginMQTT, Topic: msg.Topic(), Action: "source", Target: query}, err)
+
+}
+
+// home/speakers/airfoil/{speaker}/set, the speaker is anything the resolver understands (slug, name, alias, id).
+// payload is "on", "off", "toggle" or json like {"connected":"on","volume_level":0.4}
+var speakerSetHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+
+	if ca == nil {
+		return
+	}
+
+	parts := strings.Split(msg.Topic(), "/")
+
+	if len(parts) < 5 || parts[3] == "master_volume" || parts[3] == "source" {
+		return
+	}
+
+	payload := strings.TrimSpace(string(msg.Payload()))
+
+	e := auditEntry{Origin: auditOriginMQTT, Topic: msg.Topic(), Action: "speaker", Target: parts[3], Params: payload}
+
+	spk, err := ca.ResolveSpeaker(parts[3])
+
+	if err != nil {
+		log.Printf("MQTT Speaker %s: %s\n", parts[3], err)
+		auditCommand(e, err)
+		return
+	}
+
+	e.Target = spk.LongIdentifier
+
+	var cmd struct {
+		Connected   interface{} `json:"connected"`
+		VolumeLevel *float64    `json:"volume_level"`
+	}
+
+	if jerr := json.Unmarshal([]byte(payload), &cmd); jerr != nil {
+		cmd.Connected = payload
+	}
+
+	if cmd.VolumeLevel != nil {
+
+		if verr := checkVolume(*cmd.VolumeLevel); verr != nil {
+			log.Printf("MQTT Speaker %s Error %s\n", spk.LongIdentifier, verr)
+			auditCommand(e, verr)
+			return
+		}
+
+	}
+
+	var cerr error
+
+	switch fmt.Sprint(cmd.Connected) {
+	case "on", "true", "ON":
+		cerr = ca.Connect(spk.LongIdentifier)
+	case "off", "false", "OFF":
+		cerr = ca.Disconnect(spk.LongIdentifier)
+	case "toggle":
+		if spk.Connected {
+			cerr = ca.Disconnect(spk.LongIdentifier)
+		} else {
+			cerr = ca.Connect(spk.LongIdentifier)
+		}
+	}
+
+	if cerr == nil && cmd.VolumeLevel != nil {
+		cerr = ca.Volume(spk.LongIdentifier, *cmd.VolumeLevel)
+	}
+
+	if cerr != nil {
+		log.Printf("MQTT Speaker %s Error %s\n", spk.LongIdentifier, cerr)
+	}
+
+	auditCommand(e, cerr)
 
 }
 
@@ -313,6 +587,10 @@ var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Me
 
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 	fmt.Println("MQTT: Connected")
+
+	client.Subscribe("home/speakers/airfoil/master_volume/set", 0, masterVolumeHandler)
+	client.Subscribe("home/speakers/airfoil/source/set", 0, sourceSetHandler)
+	client.Subscribe("home/speakers/airfoil/+/set", 0, speakerSetHandler)
 }
 
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
@@ -383,15 +661,15 @@ func syncSpeakers() {
 
 	for range tick.C {
 
-		ca.SpeakerLock.RLock()
-		for _, spk := range ca.Speakers {
+		for _, spk := range ca.Snapshot().Speakers {
 
 			publishMediaPlayer(spk, mc)
 			publishPlayerState(&spk, mc)
 			publishSources()
 
 		}
-		ca.SpeakerLock.RUnlock()
+
+		publishMasterVolume(mc)
 
 	}
 
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiRoute is one /api endpoint. the same tables register the handlers and generate /openapi.json,
+// so the document can't describe a route that isn't served or miss one that is
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+	Body    interface{} //zero value of the request body, nil for none
+	Result  interface{} //zero value of the payload
+	Status  int         //success status, 202 for changes that were only sent
+	Query   []apiParam
+}
+
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+var waitParam = apiParam{Name: "wait", Type: "string", Description: "hold the response until airfoil confirms the change, 1 or a duration like 5s, at most 10s. answers 200 instead of 202"}
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+var openAPIOnce sync.Once
+var openAPIDoc []byte
+
+func httpOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	openAPIOnce.Do(func() {
+
+		var err error
+
+		if openAPIDoc, err = json.MarshalIndent(openAPI(specRoutes()), "", "  "); err != nil {
+			openAPIDoc = []byte("{}")
+		}
+
+	})
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(openAPIDoc)
+
+}
+
+// specRoutes is everything /openapi.json describes, the v2 table under its prefix and the rest of /api
+func specRoutes() []apiRoute {
+
+	var routes []apiRoute
+
+	for _, rt := range v2Routes() {
+		rt.Path = apiV2Prefix + rt.Path
+		routes = append(routes, rt)
+	}
+
+	return append(routes, apiRoutes()...)
+
+}
+
+// openAPI builds an OpenAPI 3 document for routes with full paths, schemas come from the Go types by reflection
+func openAPI(routes []apiRoute) map[string]interface{} {
+
+	g := &schemaGen{defs: make(map[string]interface{})}
+
+	paths := make(map[string]map[string]interface{})
+
+	for _, rt := range routes {
+
+		if paths[rt.Path] == nil {
+			paths[rt.Path] = make(map[string]interface{})
+		}
+
+		var params []interface{}
+
+		for _, m := range pathParam.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+		}
+
+		for _, q := range rt.Query {
+			params = append(params, map[string]interface{}{"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]interface{}{"type": q.Type}})
+		}
+
+		op := map[string]interface{}{
+			"summary":     rt.Summary,
+			"operationId": operationID(rt),
+			"responses": map[string]interface{}{
+				"default": map[string]interface{}{"$ref": "#/components/responses/Error"},
+			},
+		}
+
+		status := rt.Status
+
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		responses := op["responses"].(map[string]interface{})
+		ok := map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": envelopeSchema(g.schema(reflect.TypeOf(rt.Result)))}},
+		}
+
+		responses[strconv.Itoa(status)] = ok
+
+		for _, q := range rt.Query {
+			if q.Name == waitParam.Name {
+				responses["200"] = ok
+			}
+		}
+
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if rt.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(rt.Body))}},
+			}
+		}
+
+		paths[rt.Path][strings.ToLower(rt.Method)] = op
+
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "airfoilgo",
+			"version":     "2",
+			"description": "Every response is wrapped as {code, message, payload}, code repeats the http status",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.defs,
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "400 invalid request, 404 not found, 409 ambiguous (candidates in payload) or nothing connected, 503 not connected to airfoil, 504 not confirmed in time",
+					"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": envelopeSchema(map[string]interface{}{
+						"type": "array", "nullable": true, "items": map[string]interface{}{"type": "string"},
+					})}},
+				},
+			},
+		},
+	}
+
+}
+
+func envelopeSchema(payload map[string]interface{}) map[string]interface{} {
+
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": map[string]interface{}{
+			"code":    map[string]interface{}{"type": "integer"},
+			"message": map[string]interface{}{"type": "string"},
+			"payload": payload,
+		},
+	}
+
+}
+
+// GET /api/v2/speakers/{id} becomes getSpeakersId, the rest of /api keeps its prefix: postApiBatch
+func operationID(rt apiRoute) string {
+
+	var b strings.Builder
+
+	b.WriteString(strings.ToLower(rt.Method))
+
+	for _, part := range strings.FieldsFunc(strings.TrimPrefix(rt.Path, apiV2Prefix), func(r rune) bool { return r == '/' || r == '{' || r == '}' }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	return b.String()
+
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawType = reflect.TypeOf(json.RawMessage{})
+var textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+type schemaGen struct {
+	defs map[string]interface{}
+}
+
+// schema describes t the way encoding/json writes it, named structs end up in components
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+
+	if t == nil {
+		return map[string]interface{}{}
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType:
+		return map[string]interface{}{}
+	case t.Implements(textMarshaler):
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = map[string]interface{}{} //placeholder, the type may refer to itself
+			g.defs[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	//interface{}, anything goes
+	return map[string]interface{}{}
+
+}
+
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+
+	props := make(map[string]interface{})
+	var required []string
+
+	g.fields(t, props, &required)
+
+	out := map[string]interface{}{"type": "object", "properties": props}
+
+	if len(required) > 0 {
+		out["required"] = required
+	}
+
+	return out
+
+}
+
+func (g *schemaGen) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+
+		//embedded structs without a name are flattened, like encoding/json does
+		if f.Anonymous && name == "" {
+
+			ft := f.Type
+
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, props, required)
+				continue
+			}
+
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = g.schema(f.Type)
+
+		if !strings.Contains(tag, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+
+	}
+
+}
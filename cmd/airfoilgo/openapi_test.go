@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+
+	served := map[string]bool{}
+
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+
+		path, err := route.GetPathTemplate()
+
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+
+		//the v2 prefix itself has no methods, only the routes under it
+		methods, err := route.GetMethods()
+
+		if err != nil {
+			return nil
+		}
+
+		for _, m := range methods {
+			served[m+" "+path] = true
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	described := map[string]bool{}
+	ids := map[string]string{}
+
+	for path, ops := range openAPI(specRoutes())["paths"].(map[string]map[string]interface{}) {
+
+		for method, op := range ops {
+
+			key := strings.ToUpper(method) + " " + path
+			described[key] = true
+
+			id := op.(map[string]interface{})["operationId"].(string)
+
+			if other, ok := ids[id]; ok {
+				t.Errorf("%s and %s share the operationId %s", key, other, id)
+			}
+
+			ids[id] = key
+
+		}
+
+	}
+
+	for _, key := range sortedKeys(served) {
+
+		if !described[key] {
+			t.Errorf("%s is served but not in /openapi.json", key)
+		}
+
+	}
+
+	for _, key := range sortedKeys(described) {
+
+		if !served[key] {
+			t.Errorf("%s is in /openapi.json but not served", key)
+		}
+
+	}
+
+	for _, key := range []string{"POST /api/batch", "GET /api/audit", "GET /api/history", "GET /api/v2/speakers"} {
+
+		if !described[key] {
+			t.Errorf("%s is missing", key)
+		}
+
+	}
+
+}
+
+func sortedKeys(m map[string]bool) []string {
+
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+
+}
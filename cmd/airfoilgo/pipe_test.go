@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	client "github.com/rob121/airfoil-go"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeAirfoil points ca at a net.Pipe standing in for airfoil, with speakers already known. Every
+// request the server sends arrives on the channel as it went over the wire, airfoil's side of the
+// pipe is returned for notify
+func pipeAirfoil(t *testing.T, speakers ...client.Speaker) (<-chan map[string]interface{}, net.Conn) {
+
+	t.Helper()
+
+	local, remote := net.Pipe()
+
+	conn := client.NewConn("pipe", client.WithLogger(log.New(io.Discard, "", 0)), client.WithDialFunc(func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return local, nil
+	}))
+
+	if err := conn.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spk := range speakers {
+		spk := spk
+		conn.SetSpeaker(&spk)
+	}
+
+	sent := make(chan map[string]interface{}, 64)
+
+	go func() {
+
+		r := bufio.NewReader(remote)
+
+		for {
+
+			head, err := r.ReadString(';')
+
+			if err != nil {
+				close(sent)
+				return
+			}
+
+			n, _ := strconv.Atoi(strings.TrimSuffix(head, ";"))
+			body := make([]byte, n)
+
+			if _, err := io.ReadFull(r, body); err != nil {
+				close(sent)
+				return
+			}
+
+			var req map[string]interface{}
+			json.Unmarshal(body, &req)
+			sent <- req
+
+		}
+
+	}()
+
+	if err := conn.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the subscribe itself
+	nextRequest(t, sent)
+
+	prev, prevReady := ca, ready_to_serve
+	ca, ready_to_serve = conn, true
+
+	t.Cleanup(func() {
+		conn.Close()
+		remote.Close()
+		ca, ready_to_serve = prev, prevReady
+	})
+
+	return sent, remote
+
+}
+
+// notify writes a frame the way airfoil does
+func notify(t *testing.T, remote net.Conn, msg string) {
+
+	t.Helper()
+
+	if _, err := fmt.Fprintf(remote, "%d;%s", len(msg), msg); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+// nextRequest is the next request sent to airfoil, or a failure after a second
+func nextRequest(t *testing.T, sent <-chan map[string]interface{}) map[string]interface{} {
+
+	t.Helper()
+
+	select {
+	case req := <-sent:
+		return req
+	case <-time.After(time.Second):
+		t.Fatal("nothing was sent")
+	}
+
+	return nil
+
+}
+
+// answerSources stands in for airfoil's source list, every getSourceList is answered with the
+// running applications given, the other requests come out of the returned channel
+func answerSources(remote net.Conn, sent <-chan map[string]interface{}, running string) <-chan map[string]interface{} {
+
+	rest := make(chan map[string]interface{}, 64)
+
+	go func() {
+
+		defer close(rest)
+
+		for req := range sent {
+
+			if req["request"] != "getSourceList" {
+				rest <- req
+				continue
+			}
+
+			msg := fmt.Sprintf(`{"replyID":"%v","data":{"runningApplications":%s}}`, req["requestID"], running)
+			fmt.Fprintf(remote, "%d;%s", len(msg), msg)
+
+		}
+
+	}()
+
+	return rest
+
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the certificate files are checked for changes
+const certPoll = 10 * time.Second
+
+// corsConfig is http.cors in the config, an empty Origins list leaves CORS off
+type corsConfig struct {
+	Origins []string
+	Methods []string
+	Headers []string
+	MaxAge  int `mapstructure:"max_age"`
+}
+
+var corsConf corsConfig
+
+// serverDuration reads a timeout from the config, def when it isn't set
+func serverDuration(key string, def time.Duration) time.Duration {
+
+	if !conf.IsSet(key) {
+		return def
+	}
+
+	return conf.GetDuration(key)
+
+}
+
+func listenAddr() string {
+	return net.JoinHostPort(conf.GetString("http.bind"), conf.GetString("port"))
+}
+
+// serverTLS is nil for plain http. with http.tls.self_signed the cert and key are generated when missing
+func serverTLS() (*tls.Config, error) {
+
+	certFile := conf.GetString("http.tls.cert")
+	keyFile := conf.GetString("http.tls.key")
+	selfSigned := conf.GetBool("http.tls.self_signed")
+
+	if certFile == "" && keyFile == "" && !selfSigned {
+		return nil, nil
+	}
+
+	if certFile == "" {
+		certFile = "airfoilgo.crt"
+	}
+
+	if keyFile == "" {
+		keyFile = "airfoilgo.key"
+	}
+
+	if selfSigned {
+
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+
+			if err := writeSelfSigned(certFile, keyFile); err != nil {
+				return nil, err
+			}
+
+			log.Printf("Generated a self-signed certificate in %s\n", certFile)
+
+		}
+
+	}
+
+	cr, err := newCertReloader(certFile, keyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	go cr.watch(certPoll)
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}, nil
+
+}
+
+// certReloader serves the certificate from disk and picks up a renewed one without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+
+}
+
+func (cr *certReloader) load() error {
+
+	mod, err := cr.lastModified()
+
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = mod
+	cr.mu.Unlock()
+
+	return nil
+
+}
+
+// lastModified is the newer of the two files, a renewal usually rewrites both
+func (cr *certReloader) lastModified() (time.Time, error) {
+
+	var mod time.Time
+
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+
+		fi, err := os.Stat(f)
+
+		if err != nil {
+			return mod, err
+		}
+
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+
+	}
+
+	return mod, nil
+
+}
+
+// watch polls the files, a pair that doesn't load (half written, key not there yet) keeps the old
+// certificate and is tried again on the next change
+func (cr *certReloader) watch(every time.Duration) {
+
+	for range time.Tick(every) {
+
+		mod, err := cr.lastModified()
+
+		cr.mu.RLock()
+		changed := err == nil && !mod.Equal(cr.modTime)
+		cr.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := cr.load(); err != nil {
+			log.Printf("Unable to reload certificate %s: %s\n", cr.certFile, err)
+			continue
+		}
+
+		log.Printf("Reloaded certificate %s\n", cr.certFile)
+
+	}
+
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+
+}
+
+// writeSelfSigned makes a year long certificate for this host, localhost and the bind address
+func writeSelfSigned(certFile string, keyFile string) error {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "airfoilgo", Organization: []string{"airfoilgo"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+
+	if ip := net.ParseIP(conf.GetString("http.bind")); ip != nil && !ip.IsUnspecified() {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	//the key first, the reloader only looks once the cert is there
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+
+}
+
+func writePEM(path string, kind string, der []byte, perm os.FileMode) error {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(f, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+
+}
+
+func loadCORS() {
+
+	if !conf.IsSet("http.cors") {
+		return
+	}
+
+	if err := conf.UnmarshalKey("http.cors", &corsConf); err != nil {
+		log.Fatalf("Invalid cors config %s", err)
+	}
+
+	if len(corsConf.Methods) == 0 {
+		corsConf.Methods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+
+	if len(corsConf.Headers) == 0 {
+		corsConf.Headers = []string{"Authorization", "Content-Type"}
+	}
+
+	if corsConf.MaxAge == 0 {
+		corsConf.MaxAge = 600
+	}
+
+}
+
+func (cc corsConfig) allowed(origin string) bool {
+	return cc.listed(origin) || cc.wildcard()
+}
+
+// listed is an origin named in the config, the only ones trusted with credentials
+func (cc corsConfig) listed(origin string) bool {
+
+	for _, o := range cc.Origins {
+
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+func (cc corsConfig) wildcard() bool {
+
+	for _, o := range cc.Origins {
+
+		if o == "*" {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+// checkOrigin is for the websocket upgrader. without auth and cors config every origin is let in as
+// before. with auth on, a browser sends its saved credentials along with the handshake, so another
+// site only gets in when it is listed, a wildcard doesn't do
+func checkOrigin(r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	if auth.enabled() {
+		return corsConf.listed(origin)
+	}
+
+	return len(corsConf.Origins) == 0 || corsConf.allowed(origin)
+
+}
+
+// CORS sits in front of the router, preflight requests carry no credentials and match no route
+func CORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		origin := r.Header.Get("Origin")
+
+		if origin == "" || !corsConf.allowed(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		//"*" lets any site read the answers, but never with the caller's credentials
+		if corsConf.listed(origin) {
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsConf.Methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsConf.Headers, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsConf.MaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		}
+
+		h.ServeHTTP(w, r)
+
+	})
+}
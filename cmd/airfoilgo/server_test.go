@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+
+	prev := corsConf
+
+	defer func() {
+		corsConf = prev
+	}()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name        string
+		origins     []string
+		origin      string
+		allow       string
+		credentials string
+	}{
+		{"listed origin", []string{"https://dash.example"}, "https://dash.example", "https://dash.example", "true"},
+		{"other origin", []string{"https://dash.example"}, "https://evil.example", "", ""},
+		{"wildcard", []string{"*"}, "https://evil.example", "*", ""},
+		{"listed next to a wildcard", []string{"*", "https://dash.example"}, "https://dash.example", "https://dash.example", "true"},
+		{"wildcard next to a listed one", []string{"*", "https://dash.example"}, "https://evil.example", "*", ""},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			corsConf = corsConfig{Origins: tt.origins, Methods: []string{http.MethodGet}, Headers: []string{"Authorization"}, MaxAge: 600}
+
+			for _, method := range []string{http.MethodGet, http.MethodOptions} {
+
+				req := httptest.NewRequest(method, "/speakers", nil)
+				req.Header.Set("Origin", tt.origin)
+
+				if method == http.MethodOptions {
+					req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+				}
+
+				w := httptest.NewRecorder()
+				CORS(next).ServeHTTP(w, req)
+
+				if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+					t.Fatalf("%s Access-Control-Allow-Origin = %q, want %q", method, got, tt.allow)
+				}
+
+				if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+					t.Fatalf("%s Access-Control-Allow-Credentials = %q, want %q", method, got, tt.credentials)
+				}
+
+			}
+
+		})
+
+	}
+
+}
+
+func TestCheckOrigin(t *testing.T) {
+
+	prevCORS, prevAuth := corsConf, auth
+
+	defer func() {
+		corsConf, auth = prevCORS, prevAuth
+	}()
+
+	withAuth := authConfig{Users: []credential{{Name: "sam", Password: "s", Scope: "control"}}}
+
+	tests := []struct {
+		name    string
+		auth    authConfig
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{name: "no auth, no origins", origin: "https://evil.example", want: true},
+		{name: "no origin header", auth: withAuth, want: true},
+		{name: "same host with auth", auth: withAuth, origin: "http://airfoil.lan:8080", want: true},
+		{name: "foreign origin with auth", auth: withAuth, origin: "https://evil.example", want: false},
+		{name: "wildcard with auth", auth: withAuth, origins: []string{"*"}, origin: "https://evil.example", want: false},
+		{name: "listed with auth", auth: withAuth, origins: []string{"https://dash.example"}, origin: "https://dash.example", want: true},
+		{name: "not listed", origins: []string{"https://dash.example"}, origin: "https://evil.example", want: false},
+		{name: "wildcard without auth", origins: []string{"*"}, origin: "https://evil.example", want: true},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			auth = tt.auth
+			corsConf = corsConfig{Origins: tt.origins}
+
+			req := httptest.NewRequest(http.MethodGet, "http://airfoil.lan:8080/ws", nil)
+
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+
+			if got := checkOrigin(req); got != tt.want {
+				t.Fatalf("checkOrigin = %v, want %v", got, tt.want)
+			}
+
+		})
+
+	}
+
+}
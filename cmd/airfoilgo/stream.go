@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	client "github.com/rob121/airfoil-go"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sent first on every stream, the full state the events that follow apply to
+const eventSnapshot client.EventType = "snapshot"
+
+// a stream that can't keep up loses events rather than holding up the library
+const streamBuffer = 64
+
+// commands one websocket can have waiting on airfoil at once, more are answered busy
+const wsCommandSlots = 4
+
+var errBusy = errors.New("busy")
+
+var streamSeq uint64
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	//dashboards are usually served from somewhere else, http.cors.origins narrows it down
+	CheckOrigin: checkOrigin,
+}
+
+// eventFilter keeps the events a stream asked for, an empty filter keeps everything
+type eventFilter struct {
+	types   map[client.EventType]bool
+	speaker string
+}
+
+// streamEvent is what goes over the wire, the library event with a sequence number
+type streamEvent struct {
+	ID uint64 `json:"id"`
+	client.Event
+}
+
+// wsCommand is a message from a websocket client, Wait works like ?wait=
+type wsCommand struct {
+	ID      string   `json:"id"`
+	Command string   `json:"command"`
+	Speaker string   `json:"speaker,omitempty"`
+	Source  string   `json:"source,omitempty"`
+	Volume  *float64 `json:"volume,omitempty"`
+	Wait    string   `json:"wait,omitempty"`
+	Types   []string `json:"types,omitempty"`
+}
+
+type wsReply struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id"`
+	Status  int         `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// parseFilter reads ?type=speakerChanged,nowPlaying&speaker=kitchen, the speaker is resolved once up front
+func parseFilter(types []string, speaker string) (eventFilter, error) {
+
+	f := eventFilter{}
+
+	for _, t := range types {
+
+		for _, name := range strings.Split(t, ",") {
+
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+
+			if f.types == nil {
+				f.types = make(map[client.EventType]bool)
+			}
+
+			f.types[client.EventType(name)] = true
+
+		}
+
+	}
+
+	if speaker != "" {
+
+		spk, err := ca.ResolveSpeaker(speaker)
+
+		if err != nil {
+			return f, err
+		}
+
+		f.speaker = spk.LongIdentifier
+
+	}
+
+	return f, nil
+
+}
+
+func (f eventFilter) match(ev client.Event) bool {
+
+	if f.types != nil && !f.types[ev.Type] {
+		return false
+	}
+
+	if f.speaker != "" && ev.Speaker != f.speaker {
+		return false
+	}
+
+	return true
+
+}
+
+// subscribe forwards matching events to the returned channel until cancel is called. A client too
+// slow to keep up gets a signal on lagged instead of silently missing events, see resync
+func subscribe(f *atomic.Value) (<-chan streamEvent, <-chan struct{}, func()) {
+
+	events := make(chan streamEvent, streamBuffer)
+	lagged := make(chan struct{}, 1)
+
+	cancel := ca.Listen(func(ev client.Event) {
+
+		if !f.Load().(eventFilter).match(ev) {
+			return
+		}
+
+		select {
+		case events <- streamEvent{ID: atomic.AddUint64(&streamSeq, 1), Event: ev}:
+		default:
+			log.Printf("Event stream full, dropped %s and sending a new snapshot\n", ev.Type)
+
+			select {
+			case lagged <- struct{}{}:
+			default:
+			}
+		}
+
+	})
+
+	return events, lagged, cancel
+
+}
+
+// resync throws away what is still buffered and answers a snapshot to send instead, it covers the
+// dropped events and everything queued before it
+func resync(events <-chan streamEvent) streamEvent {
+
+	for {
+
+		select {
+		case <-events:
+		default:
+			return snapshotEvent()
+		}
+
+	}
+
+}
+
+func snapshotEvent() streamEvent {
+	return streamEvent{ID: atomic.AddUint64(&streamSeq, 1), Event: client.Event{Type: eventSnapshot, Time: time.Now(), Data: ca.Snapshot()}}
+}
+
+// GET /events, server-sent events
+func httpEventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		respondStatus(w, http.StatusInternalServerError, "Error", "Streaming Not Supported")
+		return
+	}
+
+	f, err := parseFilter(r.URL.Query()["type"], r.URL.Query().Get("speaker"))
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	var filter atomic.Value
+	filter.Store(f)
+
+	events, lagged, cancel := subscribe(&filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(ev streamEvent) error {
+
+		data, err := json.Marshal(ev)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+			return err
+		}
+
+		flusher.Flush()
+
+		return nil
+
+	}
+
+	if err := write(snapshotEvent()); err != nil {
+		return
+	}
+
+	//keeps proxies from closing an idle stream
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	for {
+
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := write(ev); err != nil {
+				return
+			}
+		case <-lagged:
+			if err := write(resync(events)); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+	}
+
+}
+
+// GET /ws, the same events as /events plus commands from the client
+func httpWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+
+	f, err := parseFilter(r.URL.Query()["type"], r.URL.Query().Get("speaker"))
+
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		log.Printf("Websocket Upgrade Error %s\n", err)
+		return
+	}
+
+	defer conn.Close()
+
+	var filter atomic.Value
+	filter.Store(f)
+
+	//the upgrade request was authenticated, commands are checked against the same principal
+	who := principalFrom(r)
+
+	events, lagged, cancel := subscribe(&filter)
+	defer cancel()
+
+	replies := make(chan wsReply, 16)
+	slots := make(chan struct{}, wsCommandSlots)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+
+	conn.SetReadLimit(64 * 1024)
+	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	})
+
+	go func() {
+
+		defer close(done)
+
+		for {
+
+			var cmd wsCommand
+
+			if err := conn.ReadJSON(&cmd); err != nil {
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+			default:
+
+				//a client firing commands faster than airfoil answers doesn't get a goroutine for each
+				select {
+				case replies <- finishCommand(cmd, wsReply{Type: "reply", ID: cmd.ID}, errBusy, who, r.RemoteAddr):
+				case <-quit:
+					return
+				}
+
+				continue
+
+			}
+
+			//a command waiting for airfoil shouldn't hold up the next one
+			go func() {
+
+				reply := runCommand(cmd, &filter, who, r.RemoteAddr)
+				<-slots
+
+				select {
+				case replies <- reply:
+				case <-done:
+				}
+
+			}()
+
+		}
+
+	}()
+
+	write := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(v)
+	}
+
+	if err := write(snapshotEvent()); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+
+		select {
+		case <-done:
+			return
+		case ev := <-events:
+			if err := write(ev); err != nil {
+				return
+			}
+		case <-lagged:
+			if err := write(resync(events)); err != nil {
+				return
+			}
+		case reply := <-replies:
+			if err := write(reply); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+
+	}
+
+}
+
+// runCommand carries out one websocket command, the reply has the same status codes as /api/v2
+func runCommand(cmd wsCommand, filter *atomic.Value, who *principal, remote string) wsReply {
+
+	reply := wsReply{Type: "reply", ID: cmd.ID}
+
+	timeout, wait := time.Duration(0), cmd.Wait != "" && cmd.Wait != "0" && cmd.Wait != "false"
+
+	if wait {
+
+		var err error
+
+		if timeout, err = time.ParseDuration(cmd.Wait); err != nil || timeout <= 0 || timeout > 10*time.Second {
+			timeout = 10 * time.Second
+		}
+
+	} else {
+		timeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+
+	switch cmd.Command {
+	case "snapshot":
+		reply.Payload = ca.Snapshot()
+	case "filter":
+		var f eventFilter
+		if f, err = parseFilter(cmd.Types, cmd.Speaker); err == nil {
+			filter.Store(f)
+		}
+	case "connect", "disconnect", "toggle", "volume":
+		if err = who.permits(scopeControl, false); err == nil {
+			err = speakerCommand(ctx, cmd, wait, who)
+		}
+	case "source":
+		if err = who.permits(scopeControl, true); err != nil {
+			break
+		}
+		if cmd.Source == "" {
+			err = badRequest("source is required")
+		} else if wait {
+			reply.Payload, err = ca.SelectSourceAndWait(ctx, cmd.Source)
+		} else {
+			reply.Payload, err = ca.SelectSource(ctx, cmd.Source)
+		}
+	case "mastervolume":
+		if err = who.permits(scopeControl, true); err != nil {
+			break
+		}
+		if cmd.Volume == nil {
+			err = badRequest("volume must be between 0 and 1")
+		} else if err = checkVolume(*cmd.Volume); err == nil {
+			err = ca.SetMasterVolume(*cmd.Volume)
+		}
+	default:
+		err = badRequest("unknown command %q", cmd.Command)
+	}
+
+	return finishCommand(cmd, reply, err, who, remote)
+
+}
+
+// finishCommand audits a command that changes something and puts err in the reply
+func finishCommand(cmd wsCommand, reply wsReply, err error, who *principal, remote string) wsReply {
+
+	if cmd.Command != "snapshot" && cmd.Command != "filter" {
+
+		target := cmd.Speaker
+
+		if cmd.Command == "source" {
+			target = cmd.Source
+		}
+
+		auditCommand(auditEntry{Origin: auditOriginWebsocket, Remote: remote, Principal: who.auditName(), Action: cmd.Command, Target: target, Params: cmd}, err)
+
+	}
+
+	reply.Status = http.StatusOK
+
+	if err != nil {
+		reply.Status = statusFor(err)
+		reply.Error = err.Error()
+		reply.Payload = nil
+	}
+
+	return reply
+
+}
+
+func speakerCommand(ctx context.Context, cmd wsCommand, wait bool, who *principal) error {
+
+	spk, err := ca.ResolveSpeaker(cmd.Speaker)
+
+	if err != nil {
+		return err
+	}
+
+	if err := who.allows(spk); err != nil {
+		return err
+	}
+
+	id := spk.LongIdentifier
+
+	connect := cmd.Command == "connect" || (cmd.Command == "toggle" && !spk.Connected)
+
+	switch {
+	case cmd.Command == "volume":
+		if cmd.Volume == nil {
+			return badRequest("volume must be between 0 and 1")
+		}
+		if err := checkVolume(*cmd.Volume); err != nil {
+			return err
+		}
+		if wait {
+			return ca.VolumeAndWait(ctx, id, *cmd.Volume)
+		}
+		return ca.Volume(id, *cmd.Volume)
+	case connect && wait:
+		return ca.ConnectAndWait(ctx, id)
+	case connect:
+		return ca.Connect(id)
+	case wait:
+		return ca.DisconnectAndWait(ctx, id)
+	}
+
+	return ca.Disconnect(id)
+
+}
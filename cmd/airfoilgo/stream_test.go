@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	client "github.com/rob121/airfoil-go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsReplies reads the websocket until n replies came, skipping the events in between
+func wsReplies(t *testing.T, ws *websocket.Conn, n int) map[string]wsReply {
+
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+
+	replies := map[string]wsReply{}
+
+	for len(replies) < n {
+
+		var raw json.RawMessage
+
+		if err := ws.ReadJSON(&raw); err != nil {
+			t.Fatalf("%d replies so far: %s", len(replies), err)
+		}
+
+		//events carry a numeric id
+		var reply wsReply
+
+		if json.Unmarshal(raw, &reply) == nil && reply.Type == "reply" {
+			replies[reply.ID] = reply
+		}
+
+	}
+
+	return replies
+
+}
+
+func TestWebsocketCommandsBusy(t *testing.T) {
+
+	sent, remote := pipeAirfoil(t, client.Speaker{LongIdentifier: "DC9B9CEFC55C@Kitchen", Name: "Kitchen"})
+
+	answerSources(remote, sent, `[]`)
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ws.Close()
+
+	//every slot waits for a connect airfoil hasn't confirmed yet
+	for i := 1; i <= wsCommandSlots+1; i++ {
+
+		if err := ws.WriteJSON(wsCommand{ID: fmt.Sprint(i), Command: "connect", Speaker: "kitchen", Wait: "5s"}); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	if reply := wsReplies(t, ws, 1)[fmt.Sprint(wsCommandSlots+1)]; reply.Status != http.StatusTooManyRequests || reply.Error != "busy" {
+		t.Fatalf("the command over the limit got %+v", reply)
+	}
+
+	notify(t, remote, `{"request":"speakerConnectedChanged","data":{"longIdentifier":"DC9B9CEFC55C@Kitchen","connected":true}}`)
+
+	replies := wsReplies(t, ws, wsCommandSlots)
+
+	for i := 1; i <= wsCommandSlots; i++ {
+
+		if reply := replies[fmt.Sprint(i)]; reply.Status != http.StatusOK {
+			t.Fatalf("command %d got %+v", i, reply)
+		}
+
+	}
+
+	//the slots are free again
+	if err := ws.WriteJSON(wsCommand{ID: "next", Command: "snapshot"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := wsReplies(t, ws, 1)["next"]; reply.Status != http.StatusOK {
+		t.Fatalf("a command after the burst got %+v", reply)
+	}
+
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+func uiHandler() http.Handler {
+
+	sub, err := fs.Sub(uiFiles, "ui")
+
+	if err != nil {
+		panic(err)
+	}
+
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+
+}
+
+// the panel itself has nothing secret in it, it asks for a token and sends it with every api call
+func isUI(path string) bool {
+	return path == "/ui" || strings.HasPrefix(path, "/ui/")
+}
@@ -0,0 +1,245 @@
+// Control panel for the airfoilgo server, talks to /api/v2 and follows /events
+(function () {
+  "use strict";
+
+  var api = "../api/v2";
+  var tokenKey = "airfoilgo.token";
+
+  var state = { speakers: {}, catalog: { categories: [] }, active: {}, nowPlaying: {} };
+  var events = null;
+  var refreshTimer = null;
+
+  function $(id) { return document.getElementById(id); }
+
+  function token() { return localStorage.getItem(tokenKey) || ""; }
+
+  function showError(msg) {
+    $("error").textContent = msg || "";
+    $("error").hidden = !msg;
+  }
+
+  // request answers the payload or throws with the server message, a 401 asks for a token
+  function request(method, path, body) {
+    var opts = { method: method, headers: { "Accept": "application/json" } };
+
+    if (token()) {
+      opts.headers["Authorization"] = "Bearer " + token();
+    }
+
+    if (body !== undefined) {
+      opts.headers["Content-Type"] = "application/json";
+      opts.body = JSON.stringify(body);
+    }
+
+    return fetch(api + path, opts).then(function (resp) {
+      return resp.json().catch(function () { return {}; }).then(function (env) {
+        if (resp.status === 401) {
+          $("login").hidden = false;
+        }
+        if (!resp.ok) {
+          throw new Error(env.message || resp.statusText);
+        }
+        return env.payload;
+      });
+    });
+  }
+
+  // airfoil sends icons and album art as base64 png
+  function image(data) {
+    if (!data) {
+      return "";
+    }
+    return data.indexOf("data:") === 0 ? data : "data:image/png;base64," + data;
+  }
+
+  function renderSpeakers() {
+    var list = $("speakers");
+    var ids = Object.keys(state.speakers).sort(function (a, b) {
+      return state.speakers[a].name.toLowerCase().localeCompare(state.speakers[b].name.toLowerCase());
+    });
+
+    list.textContent = "";
+
+    ids.forEach(function (id) {
+      var spk = state.speakers[id];
+      var li = document.createElement("li");
+      var name = document.createElement("label");
+      var toggle = document.createElement("input");
+      var volume = document.createElement("input");
+
+      li.className = spk.stale ? "stale" : "";
+
+      name.textContent = spk.name;
+      name.htmlFor = "spk-" + id;
+
+      toggle.type = "checkbox";
+      toggle.id = "spk-" + id;
+      toggle.checked = spk.connected;
+      toggle.addEventListener("change", function () {
+        update(id, { connected: toggle.checked });
+      });
+
+      volume.type = "range";
+      volume.min = 0;
+      volume.max = 100;
+      volume.value = Math.round(spk.volume * 100);
+      volume.setAttribute("aria-label", spk.name + " volume");
+      volume.addEventListener("change", function () {
+        update(id, { volume: volume.value / 100 });
+      });
+
+      li.appendChild(name);
+      li.appendChild(toggle);
+      li.appendChild(volume);
+      list.appendChild(li);
+    });
+  }
+
+  function renderSources() {
+    var box = $("sources");
+
+    box.textContent = "";
+    box.className = "sources";
+
+    state.catalog.categories.forEach(function (cat) {
+      if (!cat.sources || !cat.sources.length) {
+        return;
+      }
+
+      var head = document.createElement("h3");
+      head.textContent = cat.type.replace(/([A-Z])/g, " $1");
+      box.appendChild(head);
+
+      cat.sources.forEach(function (src) {
+        var btn = document.createElement("button");
+        var label = document.createElement("span");
+
+        btn.type = "button";
+        btn.className = "source" + (src.identifier === state.active.identifier ? " active" : "");
+
+        if (src.icon) {
+          var icon = document.createElement("img");
+          icon.src = image(src.icon);
+          icon.alt = "";
+          btn.appendChild(icon);
+        }
+
+        label.textContent = src.friendlyName;
+        btn.appendChild(label);
+
+        btn.addEventListener("click", function () {
+          request("PUT", "/sources/active", { source: src.identifier }).then(function (sel) {
+            state.active = sel;
+            renderSources();
+            showError("");
+          }).catch(function (err) { showError(err.message); });
+        });
+
+        box.appendChild(btn);
+      });
+    });
+  }
+
+  function renderNowPlaying() {
+    var np = state.nowPlaying || {};
+    var art = $("art");
+
+    $("np-title").textContent = np.title || np.sourceName || "Nothing playing";
+    $("np-artist").textContent = np.artist || "";
+    $("np-album").textContent = np.album || "";
+
+    art.hidden = !np.albumArt;
+    art.src = image(np.albumArt);
+  }
+
+  function renderState(s) {
+    $("state").textContent = s;
+    $("state").className = "state" + (s === "ready" ? " ready" : "");
+  }
+
+  function applySnapshot(snap) {
+    state.speakers = {};
+    (snap.speakers || []).forEach(function (spk) {
+      state.speakers[spk.longIdentifier] = spk;
+    });
+    state.active = snap.activeSource || {};
+    state.nowPlaying = snap.nowPlaying || {};
+
+    renderState(snap.state);
+    renderSpeakers();
+    renderNowPlaying();
+    renderSources();
+  }
+
+  function update(id, change) {
+    request("PATCH", "/speakers/" + encodeURIComponent(id), change).then(function (spk) {
+      state.speakers[id] = spk;
+      renderSpeakers();
+      showError("");
+    }).catch(function (err) {
+      showError(err.message);
+      renderSpeakers();
+    });
+  }
+
+  // anything the event doesn't carry in full is fetched again, a burst of events fetches once
+  function refresh() {
+    clearTimeout(refreshTimer);
+    refreshTimer = setTimeout(function () {
+      Promise.all([request("GET", "/snapshot"), request("GET", "/sources")]).then(function (res) {
+        state.catalog = res[1] || { categories: [] };
+        applySnapshot(res[0]);
+      }).catch(function (err) { showError(err.message); });
+    }, 200);
+  }
+
+  function listen() {
+    var url = "../events" + (token() ? "?access_token=" + encodeURIComponent(token()) : "");
+
+    if (events) {
+      events.close();
+    }
+
+    events = new EventSource(url);
+
+    events.addEventListener("snapshot", function (e) {
+      applySnapshot(JSON.parse(e.data).data);
+      refresh();
+    });
+
+    events.addEventListener("speakerChanged", function (e) {
+      var spk = JSON.parse(e.data).data;
+      state.speakers[spk.longIdentifier] = spk;
+      renderSpeakers();
+    });
+
+    events.addEventListener("nowPlaying", function (e) {
+      state.nowPlaying = JSON.parse(e.data).data;
+      renderNowPlaying();
+    });
+
+    events.addEventListener("stateChanged", function (e) {
+      renderState(JSON.parse(e.data).data);
+    });
+
+    ["speakerAdded", "speakerRemoved", "speakerRenamed", "sourceAdded", "sourceRemoved", "activeSourceChanged"].forEach(function (t) {
+      events.addEventListener(t, refresh);
+    });
+
+    events.onerror = function () {
+      renderState("reconnecting");
+    };
+  }
+
+  $("login").addEventListener("submit", function (e) {
+    e.preventDefault();
+    localStorage.setItem(tokenKey, $("token").value);
+    $("login").hidden = true;
+    showError("");
+    refresh();
+    listen();
+  });
+
+  refresh();
+  listen();
+})();
@@ -0,0 +1,136 @@
+package airfoilgo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// DispatchMode decides how inbound frames are spread over the dispatch workers
+type DispatchMode int
+
+const (
+	// one worker, every frame is applied in the order it arrived
+	DispatchOrdered DispatchMode = iota
+	// frames for the same speaker stay in order, different speakers are handled in parallel.
+	// frames without a speaker (lists, sources, metadata) all go to the first worker
+	DispatchPerSpeaker
+)
+
+type frame struct {
+	resp AirfoilResponse
+	err  error
+}
+
+// startDispatch starts the frame workers and the callback goroutine, once per AirfoilConn
+func (a *AirfoilConn) startDispatch() {
+
+	workers := 1
+
+	if a.DispatchMode == DispatchPerSpeaker && a.DispatchWorkers > 1 {
+		workers = a.DispatchWorkers
+	}
+
+	a.shards = make([]chan frame, workers)
+
+	for i := range a.shards {
+
+		a.shards[i] = make(chan frame, a.DispatchQueue)
+
+		go a.dispatchWorker(a.shards[i])
+
+	}
+
+	a.callbacks = make(chan func(), a.CallbackQueue)
+
+	go a.callbackWorker()
+
+}
+
+// dispatch blocks when the worker is behind, frames are never dropped
+func (a *AirfoilConn) dispatch(resp AirfoilResponse, err error) {
+
+	shard := 0
+
+	if len(a.shards) > 1 && resp.Data.LongIdentifier != "" {
+
+		h := fnv.New32a()
+		h.Write([]byte(resp.Data.LongIdentifier))
+		shard = int(h.Sum32() % uint32(len(a.shards)))
+
+	}
+
+	a.shards[shard] <- frame{resp: resp, err: err}
+
+}
+
+func (a *AirfoilConn) dispatchWorker(frames chan frame) {
+
+	for f := range frames {
+
+		a.intercept(f.resp, f.err)
+
+		if a.Cb != nil {
+
+			cb := a.Cb
+			resp, err := f.resp, f.err
+
+			a.callback("reader", func() {
+				cb(resp, err)
+			})
+
+		}
+
+	}
+
+}
+
+// callback queues fn for the callback goroutine, so user code never holds up the connection.
+// when the queue is full the call is dropped rather than blocking
+func (a *AirfoilConn) callback(name string, fn func()) {
+
+	if a.callbacks == nil {
+		//not dialed yet, nothing to hold up
+		a.runCallback(fn)
+		return
+	}
+
+	select {
+	case a.callbacks <- fn:
+	default:
+		a.metrics.Add("callback_dropped_total", 1)
+		a.logf("Callback queue full, dropped %s callback\n", name)
+	}
+
+}
+
+func (a *AirfoilConn) callbackWorker() {
+
+	for fn := range a.callbacks {
+		a.runCallback(fn)
+	}
+
+}
+
+func (a *AirfoilConn) runCallback(fn func()) {
+
+	start := time.Now()
+
+	defer func() {
+
+		if r := recover(); r != nil {
+			a.metrics.Add("callback_panics_total", 1)
+			a.addError(fmt.Errorf("callback panic: %v", r))
+			a.logf("Callback Panic: %v\n", r)
+		}
+
+		if took := time.Since(start); took > a.SlowCallback {
+			a.metrics.Add("callback_slow_total", 1)
+			a.logf("Slow Callback: %s\n", took)
+		}
+
+	}()
+
+	fn()
+
+}
@@ -0,0 +1,122 @@
+package airfoilgo
+
+import (
+	"time"
+)
+
+type EventType string
+
+const (
+	EventDrift EventType = "drift"
+)
+
+// Event is a state change noticed by the library, as opposed to a raw AirfoilResponse
+type Event struct {
+	Type    EventType   `json:"type"`
+	Time    time.Time   `json:"time"`
+	Speaker string      `json:"speaker,omitempty"`
+	Source  string      `json:"source,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Listen registers fn for every event, call the returned func to stop listening.
+// listeners run one at a time on their own goroutine, in the order events happened. Unlike Cb they
+// are never dropped and a slow Cb doesn't hold them up
+func (a *AirfoilConn) Listen(fn func(Event)) func() {
+
+	a.listenerLock.Lock()
+	defer a.listenerLock.Unlock()
+
+	if a.listeners == nil {
+		a.listeners = make(map[int]func(Event))
+	}
+
+	a.listenerSeq++
+	id := a.listenerSeq
+	a.listeners[id] = fn
+
+	return func() {
+		a.listenerLock.Lock()
+		delete(a.listeners, id)
+		a.listenerLock.Unlock()
+	}
+
+}
+
+func (a *AirfoilConn) emit(ev Event) {
+
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	a.recordEvent(ev)
+
+	a.listenerLock.RLock()
+	fns := make([]func(Event), 0, len(a.listeners))
+	for _, fn := range a.listeners {
+		fns = append(fns, fn)
+	}
+	a.listenerLock.RUnlock()
+
+	if len(fns) == 0 {
+		return
+	}
+
+	a.eventOnce.Do(func() {
+		a.eventReady = make(chan struct{}, 1)
+		go a.eventWorker()
+	})
+
+	a.eventLock.Lock()
+
+	for _, fn := range fns {
+
+		listener := fn
+
+		a.eventQueue = append(a.eventQueue, func() {
+			listener(ev)
+		})
+
+	}
+
+	depth := len(a.eventQueue)
+
+	a.eventLock.Unlock()
+
+	a.metrics.Set("event_queue_depth", float64(depth))
+
+	select {
+	case a.eventReady <- struct{}{}:
+	default:
+	}
+
+}
+
+// eventWorker runs the queued listeners, the queue grows rather than drop an event: WaitFor, the
+// streams and anything auditing changes would silently miss it
+func (a *AirfoilConn) eventWorker() {
+
+	for range a.eventReady {
+
+		for {
+
+			a.eventLock.Lock()
+
+			if len(a.eventQueue) == 0 {
+				a.eventLock.Unlock()
+				break
+			}
+
+			fn := a.eventQueue[0]
+			a.eventQueue[0] = nil
+			a.eventQueue = a.eventQueue[1:]
+
+			a.eventLock.Unlock()
+
+			a.runCallback(fn)
+
+		}
+
+	}
+
+}
@@ -0,0 +1,70 @@
+package airfoilgo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestListenersSurviveSlowCallbacks(t *testing.T) {
+
+	release := make(chan struct{})
+	defer close(release)
+
+	a, remote, _ := pipeConn(t, func(a *AirfoilConn) {
+		a.CallbackQueue = 1
+	})
+
+	//a user callback stuck on something slow fills the callback queue
+	a.Cb = func(AirfoilResponse, error) {
+		<-release
+	}
+
+	got := make(chan Event, 500)
+
+	a.Listen(func(ev Event) {
+		got <- ev
+	})
+
+	a.SetSpeaker(&Speaker{LongIdentifier: "AA@Kitchen", Name: "Kitchen"})
+
+	for i := 0; i < 200; i++ {
+		notify(t, remote, `{"request":"speakerConnectedChanged","data":{"longIdentifier":"AA@Kitchen","connected":true}}`)
+	}
+
+	for i := 0; i < 200; i++ {
+
+		select {
+		case <-got:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of 200 events reached the listener", i)
+		}
+
+	}
+
+}
+
+func TestWaitForRechecksWithoutEvents(t *testing.T) {
+
+	a := NewConn("x")
+
+	a.SetSpeaker(&Speaker{LongIdentifier: "AA@Kitchen", Name: "Kitchen"})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		//straight into the cache, no event
+		a.SetSpeaker(&Speaker{LongIdentifier: "AA@Kitchen", Name: "Kitchen", Connected: true})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	spk, err := a.WaitForSpeaker(ctx, "AA@Kitchen", func(spk Speaker) bool {
+		return spk.Connected
+	})
+
+	if err != nil || !spk.Connected {
+		t.Fatalf("WaitForSpeaker = %+v, %v", spk, err)
+	}
+
+}
@@ -0,0 +1,69 @@
+package airfoilgo
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Health is what probes and diagnostics need to know about the session
+type Health struct {
+	State      ConnState `json:"state"`
+	Address    string    `json:"address"`
+	Subscribed bool      `json:"subscribed"`
+	LastFrame  time.Time `json:"lastFrame"`
+	LastReply  time.Time `json:"lastReply"`
+	Missed     int       `json:"missed"`
+	Redials    int       `json:"redials"`
+	Errors     []string  `json:"errors"`
+}
+
+// LastFrame is when anything last arrived from airfoil, zero before the first read
+func (a *AirfoilConn) LastFrame() time.Time {
+
+	n := atomic.LoadInt64(&a.lastFrame)
+
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+
+}
+
+// Subscribed is true once airfoil answered the subscribe of the current session
+func (a *AirfoilConn) Subscribed() bool {
+	return atomic.LoadInt32(&a.subscribed) == 1
+}
+
+// RecentErrors returns a copy of the last errors, oldest first. Reading Errors directly races the writer
+func (a *AirfoilConn) RecentErrors() []error {
+
+	a.errLock.Lock()
+	defer a.errLock.Unlock()
+
+	return append([]error(nil), a.Errors...)
+
+}
+
+func (a *AirfoilConn) Health() Health {
+
+	hb := a.Heartbeat()
+
+	h := Health{
+		State:      a.State(),
+		Address:    a.Address,
+		Subscribed: a.Subscribed(),
+		LastFrame:  a.LastFrame(),
+		LastReply:  hb.LastReply,
+		Missed:     hb.Missed,
+		Redials:    hb.Redials,
+		Errors:     []string{},
+	}
+
+	for _, err := range a.RecentErrors() {
+		h.Errors = append(h.Errors, err.Error())
+	}
+
+	return h
+
+}
@@ -0,0 +1,149 @@
+package airfoilgo
+
+import (
+	"context"
+	"time"
+)
+
+// HeartbeatStatus is what the last heartbeats found out about the session
+type HeartbeatStatus struct {
+	RTT       time.Duration `json:"rtt"`
+	LastReply time.Time     `json:"lastReply"`
+	Missed    int           `json:"missed"`
+	Redials   int           `json:"redials"`
+}
+
+// KeepAlive pings the live session every HeartbeatEvery and redials, following the Reconnect policy,
+// once Reconnect.Misses replies in a row never came
+func (a *AirfoilConn) KeepAlive() {
+
+	tick := time.NewTicker(a.HeartbeatEvery)
+
+	for range tick.C {
+
+		stat := a.Ping()
+
+		if stat == nil {
+			continue
+		}
+
+		a.logf("Heartbeat Missed: %s\n", stat)
+
+		a.heartbeatLock.Lock()
+		a.heartbeat.Missed++
+		missed := a.heartbeat.Missed
+		a.heartbeatLock.Unlock()
+
+		a.metrics.Add("heartbeat_missed_total", 1)
+		a.metrics.Set("heartbeat_missed", float64(missed))
+
+		if missed < a.Reconnect.Misses || a.Reconnect.Disabled {
+			continue
+		}
+
+		a.logf("Session dead after %d missed heartbeats, redialing\n", missed)
+
+		a.redial()
+
+	}
+
+}
+
+// redial keeps trying until a dial succeeds, backing off between failures
+func (a *AirfoilConn) redial() {
+
+	wait := a.Reconnect.Backoff
+
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	for {
+
+		if a.Reconnect.Rescan {
+
+			res, _ := Scan()
+
+			if len(res) > 0 {
+				a.Address = res[0]
+			}
+
+		}
+
+		a.setStatus(StateDisconnected) //reset and redial!
+
+		a.metrics.Add("redials_total", 1)
+
+		derr := a.Dial()
+
+		if derr == nil {
+			break
+		}
+
+		a.addError(derr)
+		a.logf("Redial Error: %s, retrying in %s\n", derr, wait)
+
+		time.Sleep(wait)
+
+		wait = wait * 2
+
+		if a.Reconnect.MaxBackoff > 0 && wait > a.Reconnect.MaxBackoff {
+			wait = a.Reconnect.MaxBackoff
+		}
+
+	}
+
+	a.heartbeatLock.Lock()
+	a.heartbeat.Missed = 0
+	a.heartbeat.Redials++
+	a.heartbeatLock.Unlock()
+
+}
+
+// Ping makes one round trip over the existing session, a tiny getSourceList is the cheapest request airfoil answers
+func (a *AirfoilConn) Ping() error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.HeartbeatTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := a.Request(ctx, "getSourceList", DataRequest{IconSize: 1, ScaleFactor: 1})
+
+	if err != nil {
+		return err
+	}
+
+	rtt := time.Since(start)
+
+	a.heartbeatLock.Lock()
+	a.heartbeat.RTT = rtt
+	a.heartbeat.LastReply = time.Now()
+	a.heartbeat.Missed = 0
+	a.heartbeatLock.Unlock()
+
+	a.metrics.Set("heartbeat_rtt_seconds", rtt.Seconds())
+	a.metrics.Set("heartbeat_missed", 0)
+
+	return nil
+
+}
+
+// RTT is the round trip time measured by the latest heartbeat
+func (a *AirfoilConn) RTT() time.Duration {
+
+	a.heartbeatLock.RLock()
+	defer a.heartbeatLock.RUnlock()
+
+	return a.heartbeat.RTT
+
+}
+
+func (a *AirfoilConn) Heartbeat() HeartbeatStatus {
+
+	a.heartbeatLock.RLock()
+	defer a.heartbeatLock.RUnlock()
+
+	return a.heartbeat
+
+}
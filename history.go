@@ -0,0 +1,210 @@
+package airfoilgo
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// how many log lines can wait for the HistoryLog writer
+const historyLogQueue = 1024
+
+const (
+	HistoryEvent        = "event"        //something the library emitted to listeners
+	HistoryNotification = "notification" //a push from airfoil, as it arrived
+)
+
+// HistoryEntry is one notification or state change kept for looking back at later
+type HistoryEntry struct {
+	Time    time.Time   `json:"time"`
+	Kind    string      `json:"kind"`
+	Type    string      `json:"type"`
+	Speaker string      `json:"speaker,omitempty"`
+	Source  string      `json:"source,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// HistoryQuery narrows History, zero values match everything. Types match the type or the kind
+type HistoryQuery struct {
+	Speaker string
+	Types   []string
+	Since   time.Time
+	Limit   int
+}
+
+// History returns the kept entries matching q, newest first
+func (a *AirfoilConn) History(q HistoryQuery) []HistoryEntry {
+
+	a.historyLock.Lock()
+	defer a.historyLock.Unlock()
+
+	out := []HistoryEntry{}
+	n := len(a.history)
+
+	for i := 0; i < n; i++ {
+
+		//historyNext is the oldest once the ring is full, so walk back from the one before it
+		e := a.history[(a.historyNext-1-i+n)%n]
+
+		if !q.Since.IsZero() && e.Time.Before(q.Since) {
+			break
+		}
+
+		if q.Speaker != "" && !strings.EqualFold(q.Speaker, e.Speaker) {
+			continue
+		}
+
+		if len(q.Types) > 0 && !historyTypeMatches(e, q.Types) {
+			continue
+		}
+
+		out = append(out, e)
+
+		if q.Limit > 0 && len(out) >= q.Limit {
+			break
+		}
+
+	}
+
+	return out
+
+}
+
+func historyTypeMatches(e HistoryEntry, types []string) bool {
+
+	for _, t := range types {
+
+		if strings.EqualFold(t, e.Type) || strings.EqualFold(t, e.Kind) {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+// recordEvent keeps ev, drift is only kept once something was sent to fix it
+// since the reconciler reports the same drift on every pass
+func (a *AirfoilConn) recordEvent(ev Event) {
+
+	if d, ok := ev.Data.(Drift); ev.Type == EventDrift && (!ok || !d.Corrected) {
+		return
+	}
+
+	a.record(HistoryEntry{
+		Time:    ev.Time,
+		Kind:    HistoryEvent,
+		Type:    string(ev.Type),
+		Speaker: ev.Speaker,
+		Source:  ev.Source,
+		Data:    historyData(ev.Data),
+	})
+
+}
+
+// recordNotification keeps a push from airfoil, replies to our own requests are left out
+func (a *AirfoilConn) recordNotification(response AirfoilResponse) {
+
+	if response.Request == "" {
+		return
+	}
+
+	e := HistoryEntry{
+		Time:    time.Now(),
+		Kind:    HistoryNotification,
+		Type:    response.Request,
+		Speaker: response.Data.LongIdentifier,
+	}
+
+	var frame struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	if json.Unmarshal(response.Raw, &frame) == nil && len(frame.Data) > 0 && string(frame.Data) != "{}" {
+		e.Data = frame.Data
+	}
+
+	a.record(e)
+
+}
+
+func (a *AirfoilConn) record(e HistoryEntry) {
+
+	if a.HistorySize <= 0 && a.HistoryLog == nil {
+		return
+	}
+
+	a.historyLock.Lock()
+	defer a.historyLock.Unlock()
+
+	if a.HistorySize > 0 {
+
+		if len(a.history) < a.HistorySize {
+			a.history = append(a.history, e)
+		} else {
+			a.history[a.historyNext%len(a.history)] = e
+		}
+
+		a.historyNext = (a.historyNext + 1) % a.HistorySize
+
+	}
+
+	if a.HistoryLog == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+
+	if err != nil {
+		a.logf("History Error %s\n", err)
+		return
+	}
+
+	a.historyOnce.Do(func() {
+		a.historyLines = make(chan []byte, historyLogQueue)
+		go a.historyWriter(a.HistoryLog)
+	})
+
+	//still under the lock so the log keeps the order of the ring. a slow disk drops lines
+	//rather than hold up the reader
+	select {
+	case a.historyLines <- append(line, '\n'):
+	default:
+		a.metrics.Add("history_log_dropped_total", 1)
+	}
+
+}
+
+// historyWriter writes the log lines record queued, off the goroutines that handle airfoil's frames
+func (a *AirfoilConn) historyWriter(w io.Writer) {
+
+	for line := range a.historyLines {
+
+		if _, err := w.Write(line); err != nil {
+			a.logf("History Error %s\n", err)
+		}
+
+	}
+
+}
+
+// historyData drops icons and album art, they would make up most of the buffer
+func historyData(data interface{}) interface{} {
+
+	switch d := data.(type) {
+	case NowPlaying:
+		d.AlbumArt, d.Icon = "", ""
+		return d
+	case Source:
+		d.Icon = ""
+		return d
+	case ActiveSourceChange:
+		d.Source.Icon, d.Previous.Icon = "", ""
+		return d
+	}
+
+	return data
+
+}
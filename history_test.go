@@ -0,0 +1,157 @@
+package airfoilgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistoryWrapsAround(t *testing.T) {
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		size     int
+		recorded int
+		query    HistoryQuery
+		want     []string
+	}{
+		{name: "not full", size: 3, recorded: 2, want: []string{"1", "0"}},
+		{name: "just full", size: 3, recorded: 3, want: []string{"2", "1", "0"}},
+		{name: "wrapped once", size: 3, recorded: 4, want: []string{"3", "2", "1"}},
+		{name: "wrapped twice", size: 3, recorded: 7, want: []string{"6", "5", "4"}},
+		{name: "one entry", size: 1, recorded: 4, want: []string{"3"}},
+		{name: "limit across the wrap", size: 3, recorded: 5, query: HistoryQuery{Limit: 2}, want: []string{"4", "3"}},
+		{name: "since across the wrap", size: 4, recorded: 6, query: HistoryQuery{Since: base.Add(3 * time.Second)}, want: []string{"5", "4", "3"}},
+		{name: "type across the wrap", size: 4, recorded: 9, query: HistoryQuery{Types: []string{"7"}}, want: []string{"7"}},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			a := NewConn("x", WithHistory(tt.size, nil))
+
+			for i := 0; i < tt.recorded; i++ {
+				a.record(HistoryEntry{Time: base.Add(time.Duration(i) * time.Second), Kind: HistoryEvent, Type: strconv.Itoa(i)})
+			}
+
+			var got []string
+
+			for _, e := range a.History(tt.query) {
+				got = append(got, e.Type)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+
+			}
+
+		})
+
+	}
+
+}
+
+// stuckWriter holds every write until release is closed
+type stuckWriter struct {
+	release chan struct{}
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *stuckWriter) Write(p []byte) (int, error) {
+
+	<-w.release
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.buf.Write(p)
+
+}
+
+func (w *stuckWriter) lines() []HistoryEntry {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var out []HistoryEntry
+
+	dec := json.NewDecoder(bytes.NewReader(w.buf.Bytes()))
+
+	for dec.More() {
+
+		var e HistoryEntry
+
+		if dec.Decode(&e) != nil {
+			break
+		}
+
+		out = append(out, e)
+
+	}
+
+	return out
+
+}
+
+func TestHistoryLogDoesNotBlock(t *testing.T) {
+
+	w := &stuckWriter{release: make(chan struct{})}
+
+	a := NewConn("x", WithHistory(10, w))
+
+	done := make(chan struct{})
+
+	go func() {
+
+		for i := 0; i < 5; i++ {
+			a.recordNotification(AirfoilResponse{Request: "speakerConnectedChanged", Data: DataResponse{LongIdentifier: strconv.Itoa(i)}})
+		}
+
+		close(done)
+
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recording waited for the log writer")
+	}
+
+	close(w.release)
+
+	deadline := time.Now().Add(time.Second)
+
+	for len(w.lines()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := w.lines()
+
+	if len(lines) != 5 {
+		t.Fatalf("%d of 5 lines written", len(lines))
+	}
+
+	for i, e := range lines {
+
+		if e.Speaker != strconv.Itoa(i) {
+			t.Fatalf("line %d is %+v, out of order", i, e)
+		}
+
+	}
+
+}
@@ -0,0 +1,54 @@
+package airfoilgo
+
+import (
+	"sync"
+)
+
+// Metrics is a tiny registry of named counters and gauges, exported through AirfoilConn.Metrics
+type Metrics struct {
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{values: make(map[string]float64)}
+}
+
+// Add increments a counter
+func (m *Metrics) Add(name string, v float64) {
+
+	m.lock.Lock()
+	m.values[name] += v
+	m.lock.Unlock()
+
+}
+
+// Set replaces a gauge
+func (m *Metrics) Set(name string, v float64) {
+
+	m.lock.Lock()
+	m.values[name] = v
+	m.lock.Unlock()
+
+}
+
+func (m *Metrics) Snapshot() map[string]float64 {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	out := make(map[string]float64, len(m.values))
+
+	for k, v := range m.values {
+		out[k] = v
+	}
+
+	return out
+
+}
+
+func (a *AirfoilConn) Metrics() map[string]float64 {
+
+	return a.metrics.Snapshot()
+
+}
@@ -0,0 +1,157 @@
+package airfoilgo
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Option configures an AirfoilConn in NewConn
+type Option func(*AirfoilConn)
+
+// ReconnectPolicy decides what KeepAlive does once the session is declared dead
+type ReconnectPolicy struct {
+	Disabled   bool          //never redial, leave it to the caller
+	Misses     int           //missed heartbeats in a row before the session is dead
+	Rescan     bool          //look for airfoil on the network again before redialing
+	Backoff    time.Duration //wait before the first retry of a failed dial, doubled per attempt
+	MaxBackoff time.Duration
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{Misses: 3, Rescan: true, Backoff: time.Second, MaxBackoff: time.Minute}
+
+// DefaultMetadataFields is what FetchMetadata asks for, numbers are icon / artwork sizes
+var DefaultMetadataFields = RequestedData{Album: true, RemoteControlAvailable: true, MachineIconAndScreenshot: 64, Bundleid: true, AlbumArt: 64, SourceName: true, Title: true, Icon: 16, TrackMetadataAvailable: true, Artist: true, MachineModel: true, MachineName: true}
+
+func WithDialTimeout(d time.Duration) Option {
+	return func(a *AirfoilConn) {
+		a.DialTimeout = d
+	}
+}
+
+// WithWriteTimeout fails a write that takes longer than d and drops the connection, 0 disables the deadline
+func WithWriteTimeout(d time.Duration) Option {
+	return func(a *AirfoilConn) {
+		a.WriteTimeout = d
+	}
+}
+
+// WithReadTimeout drops the session when nothing at all was read for d, keep it above the heartbeat interval
+func WithReadTimeout(d time.Duration) Option {
+	return func(a *AirfoilConn) {
+		a.ReadTimeout = d
+	}
+}
+
+func WithDialer(d *net.Dialer) Option {
+	return func(a *AirfoilConn) {
+		a.Dialer = d
+	}
+}
+
+// WithDialFunc replaces the dialer entirely, handy for tunnels and tests
+func WithDialFunc(fn func(ctx context.Context, network string, addr string) (net.Conn, error)) Option {
+	return func(a *AirfoilConn) {
+		a.DialFunc = fn
+	}
+}
+
+func WithLogger(l *log.Logger) Option {
+	return func(a *AirfoilConn) {
+		a.Logger = l
+	}
+}
+
+// WithSourceIcons sets the icon size and scale factor asked for by FetchSources
+func WithSourceIcons(size int, scale int) Option {
+	return func(a *AirfoilConn) {
+		a.SourceIconSize = size
+		a.SourceScale = scale
+	}
+}
+
+// WithMetadataScale sets the scale factor for the artwork returned by FetchMetadata
+func WithMetadataScale(scale int) Option {
+	return func(a *AirfoilConn) {
+		a.MetadataScale = scale
+	}
+}
+
+func WithMetadataFields(fields RequestedData) Option {
+	return func(a *AirfoilConn) {
+		a.MetadataFields = fields
+	}
+}
+
+func WithNotifications(notifications []string) Option {
+	return func(a *AirfoilConn) {
+		a.Notifications = append([]string(nil), notifications...)
+	}
+}
+
+// WithSpeakerAliases makes each alias resolve to the speaker it maps to, by long identifier or by
+// name or nickname
+func WithSpeakerAliases(aliases map[string]string) Option {
+	return func(a *AirfoilConn) {
+		for alias, id := range aliases {
+			a.aliases[strings.ToLower(alias)] = id
+		}
+	}
+}
+
+// WithSourceAliases makes each alias resolve to the source identifier it maps to
+func WithSourceAliases(aliases map[string]string) Option {
+	return func(a *AirfoilConn) {
+		for alias, ident := range aliases {
+			a.sourceAliases[strings.ToLower(alias)] = ident
+		}
+	}
+}
+
+func WithReconnectPolicy(p ReconnectPolicy) Option {
+	return func(a *AirfoilConn) {
+		a.Reconnect = p
+	}
+}
+
+func WithHeartbeat(every time.Duration, timeout time.Duration) Option {
+	return func(a *AirfoilConn) {
+		a.HeartbeatEvery = every
+		a.HeartbeatTimeout = timeout
+	}
+}
+
+func WithQueueSize(size int) Option {
+	return func(a *AirfoilConn) {
+		a.QueueSize = size
+	}
+}
+
+func WithDispatch(mode DispatchMode, workers int) Option {
+	return func(a *AirfoilConn) {
+		a.DispatchMode = mode
+		a.DispatchWorkers = workers
+	}
+}
+
+// WithHistory keeps the last size notifications and events for History, w gets every one as a json line
+func WithHistory(size int, w io.Writer) Option {
+	return func(a *AirfoilConn) {
+		a.HistorySize = size
+		a.HistoryLog = w
+	}
+}
+
+func (a *AirfoilConn) logf(format string, v ...interface{}) {
+
+	if a.Logger != nil {
+		a.Logger.Printf(format, v...)
+		return
+	}
+
+	log.Printf(format, v...)
+
+}
@@ -0,0 +1,114 @@
+package airfoilgo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialPipe is an AirfoilConn in the ready state dialed to the returned end of a net.Pipe,
+// nothing reads what it writes
+func dialPipe(t *testing.T, opts ...Option) (*AirfoilConn, net.Conn) {
+
+	t.Helper()
+
+	local, remote := net.Pipe()
+
+	opts = append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+
+	a := NewConn("pipe", opts...)
+	a.DialFunc = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return local, nil
+	}
+
+	if err := a.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	a.setStatus(StateReady)
+
+	t.Cleanup(func() {
+		a.Close()
+		remote.Close()
+	})
+
+	return a, remote
+
+}
+
+// pipeConn is dialPipe with every request written arriving on the channel as it went over the wire
+func pipeConn(t *testing.T, opts ...Option) (*AirfoilConn, net.Conn, <-chan map[string]interface{}) {
+
+	t.Helper()
+
+	a, remote := dialPipe(t, opts...)
+
+	sent := make(chan map[string]interface{}, 64)
+
+	go func() {
+
+		r := bufio.NewReader(remote)
+
+		for {
+
+			head, err := r.ReadString(';')
+
+			if err != nil {
+				close(sent)
+				return
+			}
+
+			n, _ := strconv.Atoi(strings.TrimSuffix(head, ";"))
+			body := make([]byte, n)
+
+			if _, err := io.ReadFull(r, body); err != nil {
+				close(sent)
+				return
+			}
+
+			var req map[string]interface{}
+			json.Unmarshal(body, &req)
+			sent <- req
+
+		}
+
+	}()
+
+	return a, remote, sent
+
+}
+
+// notify writes a frame the way airfoil does
+func notify(t *testing.T, remote net.Conn, msg string) {
+
+	t.Helper()
+
+	if _, err := fmt.Fprintf(remote, "%d;%s", len(msg), msg); err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+// nextRequest is the next request written, or a failure after a second
+func nextRequest(t *testing.T, sent <-chan map[string]interface{}) map[string]interface{} {
+
+	t.Helper()
+
+	select {
+	case req := <-sent:
+		return req
+	case <-time.After(time.Second):
+		t.Fatal("nothing was sent")
+	}
+
+	return nil
+
+}
@@ -0,0 +1,300 @@
+package airfoilgo
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// DesiredSpeaker leaves a field nil when the reconciler should not care about it
+type DesiredSpeaker struct {
+	Connected *bool    `json:"connected,omitempty"`
+	Volume    *float64 `json:"volume,omitempty"`
+}
+
+type DesiredState struct {
+	Speakers map[string]DesiredSpeaker `json:"speakers"`
+	Source   string                    `json:"source,omitempty"`
+}
+
+// Drift is one field where the live state differs from the desired state
+type Drift struct {
+	Speaker   string      `json:"speaker,omitempty"`
+	Field     string      `json:"field"`
+	Want      interface{} `json:"want"`
+	Have      interface{} `json:"have"`
+	Attempt   int         `json:"attempt"`
+	Corrected bool        `json:"corrected,omitempty"` //a command was sent on this pass, not held back by the backoff
+	Error     string      `json:"error,omitempty"`
+}
+
+type backoffState struct {
+	attempts int
+	next     time.Time
+}
+
+// Reconciler keeps nudging Airfoil toward a DesiredState, commands are only resent after a backoff
+type Reconciler struct {
+	Conn            *AirfoilConn
+	Interval        time.Duration
+	VolumeTolerance float64
+	MinBackoff      time.Duration
+	MaxBackoff      time.Duration
+	lock            sync.Mutex
+	desired         DesiredState
+	backoff         map[string]*backoffState
+	drifting        map[string]bool //what drifted on the last pass, so an incident is only counted once
+	kick            chan struct{}
+}
+
+// correction is a command the pass decided to send, drift is its index in the pass's drifts
+type correction struct {
+	drift int
+	fix   func() error
+}
+
+func NewReconciler(conn *AirfoilConn) *Reconciler {
+
+	return &Reconciler{
+		Conn:            conn,
+		Interval:        time.Second * 5,
+		VolumeTolerance: 0.02,
+		MinBackoff:      time.Second * 2,
+		MaxBackoff:      time.Minute * 2,
+		backoff:         make(map[string]*backoffState),
+		drifting:        make(map[string]bool),
+		kick:            make(chan struct{}, 1),
+	}
+
+}
+
+func (r *Reconciler) SetDesired(ds DesiredState) {
+
+	r.lock.Lock()
+	r.desired = ds
+	//new intent, forget about earlier failures
+	r.backoff = make(map[string]*backoffState)
+	r.drifting = make(map[string]bool)
+	r.lock.Unlock()
+
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+
+}
+
+func (r *Reconciler) Desired() DesiredState {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.desired
+
+}
+
+// Run reconciles every Interval, or right away when the desired state changes, until ctx is done
+func (r *Reconciler) Run(ctx context.Context) {
+
+	tick := time.NewTicker(r.Interval)
+	defer tick.Stop()
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-r.kick:
+		}
+
+		r.Reconcile()
+
+	}
+
+}
+
+// Reconcile makes one pass, issues the corrective commands that are due and returns the drift it found.
+// speaker keys can be anything ResolveSpeaker understands, like the desired source
+func (r *Reconciler) Reconcile() []Drift {
+
+	r.lock.Lock()
+
+	var drifts []Drift
+	var fixes []correction
+
+	seen := make(map[string]bool)
+
+	found := func(d Drift, key string, fix func() error) {
+
+		seen[key] = true
+
+		d, due := r.drift(d, key, fix != nil)
+
+		if due {
+			fixes = append(fixes, correction{drift: len(drifts), fix: fix})
+		}
+
+		drifts = append(drifts, d)
+
+	}
+
+	m := r.Conn.metrics
+
+	m.Add("reconcile_runs_total", 1)
+
+	for key, want := range r.desired.Speakers {
+
+		want := want
+
+		spk, err := r.Conn.ResolveSpeaker(key)
+
+		if err != nil {
+			//nothing we can send for a speaker airfoil doesn't know about
+			found(Drift{Speaker: key, Field: "present", Want: true, Have: false}, key+"|present", nil)
+			continue
+		}
+
+		id := spk.LongIdentifier
+
+		if want.Connected != nil && *want.Connected != spk.Connected {
+
+			found(Drift{Speaker: id, Field: "connected", Want: *want.Connected, Have: spk.Connected}, id+"|connected", func() error {
+
+				if *want.Connected {
+					return r.Conn.Connect(id)
+				}
+
+				return r.Conn.Disconnect(id)
+
+			})
+
+		} else {
+			delete(r.backoff, id+"|connected")
+		}
+
+		//volume only matters once the speaker is (or is about to be) connected
+		connected := spk.Connected
+
+		if want.Connected != nil {
+			connected = *want.Connected
+		}
+
+		if want.Volume != nil && connected && math.Abs(*want.Volume-spk.Volume) > r.VolumeTolerance {
+
+			vol := *want.Volume
+
+			found(Drift{Speaker: id, Field: "volume", Want: vol, Have: spk.Volume}, id+"|volume", func() error {
+				return r.Conn.Volume(id, vol)
+			})
+
+		} else {
+			delete(r.backoff, id+"|volume")
+		}
+
+	}
+
+	//the desired source can be anything ResolveSource understands, a name or alias reads better in config
+	wantSource := r.desired.Source
+
+	if wantSource != "" {
+
+		if src, err := r.Conn.ResolveSource(wantSource); err == nil {
+			wantSource = src.Identifier
+		}
+
+	}
+
+	if wantSource != "" && wantSource != r.Conn.ActiveSource().Identifier {
+
+		src := wantSource
+
+		found(Drift{Field: "source", Want: src, Have: r.Conn.ActiveSource().Identifier}, "|source", func() error {
+			return r.Conn.SetSource(src)
+		})
+
+	} else {
+		delete(r.backoff, "|source")
+	}
+
+	r.drifting = seen
+
+	m.Set("reconcile_drifting", float64(len(drifts)))
+
+	r.lock.Unlock()
+
+	//a command can wait on a full write queue, that must not hold up SetDesired or Desired
+	for _, c := range fixes {
+
+		if err := c.fix(); err != nil {
+			m.Add("reconcile_errors_total", 1)
+			drifts[c.drift].Error = err.Error()
+		}
+
+	}
+
+	//listeners may well call back into the reconciler, so report outside the lock
+	for _, d := range drifts {
+		r.Conn.emit(Event{Type: EventDrift, Speaker: d.Speaker, Data: d})
+	}
+
+	return drifts
+
+}
+
+// drift counts d the first time key drifts and says whether a fix is due, the backoff for key
+// starts over from when it is
+func (r *Reconciler) drift(d Drift, key string, fixable bool) (Drift, bool) {
+
+	m := r.Conn.metrics
+
+	if !r.drifting[key] {
+		m.Add("reconcile_drift_total", 1)
+	}
+
+	if !fixable {
+		return d, false
+	}
+
+	bo, ok := r.backoff[key]
+
+	if !ok {
+		bo = &backoffState{}
+		r.backoff[key] = bo
+	}
+
+	due := time.Now().After(bo.next)
+
+	if due {
+
+		bo.attempts++
+		bo.next = time.Now().Add(r.backoffFor(bo.attempts))
+
+		m.Add("reconcile_corrections_total", 1)
+
+		d.Corrected = true
+
+	}
+
+	d.Attempt = bo.attempts
+
+	return d, due
+
+}
+
+func (r *Reconciler) backoffFor(attempts int) time.Duration {
+
+	wait := r.MinBackoff
+
+	for i := 1; i < attempts && wait < r.MaxBackoff; i++ {
+		wait = wait * 2
+	}
+
+	if wait > r.MaxBackoff {
+		wait = r.MaxBackoff
+	}
+
+	return wait
+
+}
@@ -0,0 +1,93 @@
+package airfoilgo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconcileByName(t *testing.T) {
+
+	a, _, sent := pipeConn(t)
+
+	a.SetSpeaker(&Speaker{LongIdentifier: "AA11BB22CC33@Kitchen", Name: "Kitchen", Connected: true, Volume: 0.5})
+
+	r := NewReconciler(a)
+
+	silence := 0.0
+	r.SetDesired(DesiredState{Speakers: map[string]DesiredSpeaker{"kitchen": {Volume: &silence}}})
+
+	drifts := r.Reconcile()
+
+	if len(drifts) != 1 || drifts[0].Speaker != "AA11BB22CC33@Kitchen" || !drifts[0].Corrected {
+		t.Fatalf("unexpected drift %+v", drifts)
+	}
+
+	req := nextRequest(t, sent)
+	data := req["data"].(map[string]interface{})
+
+	if req["request"] != "setSpeakerVolume" || data["longIdentifier"] != "AA11BB22CC33@Kitchen" || data["volume"] != 0.0 {
+		t.Fatalf("unexpected request %v", req)
+	}
+
+	//still drifting on the next pass, held back by the backoff and not counted again
+	drifts = r.Reconcile()
+
+	if len(drifts) != 1 || drifts[0].Corrected {
+		t.Fatalf("unexpected drift %+v", drifts)
+	}
+
+	if n := a.Metrics()["reconcile_drift_total"]; n != 1 {
+		t.Fatalf("reconcile_drift_total is %v, want 1", n)
+	}
+
+	//fixed, then drifting again is a new incident
+	a.SetSpeaker(&Speaker{LongIdentifier: "AA11BB22CC33@Kitchen", Name: "Kitchen", Connected: true})
+	r.Reconcile()
+
+	a.SetSpeaker(&Speaker{LongIdentifier: "AA11BB22CC33@Kitchen", Name: "Kitchen", Connected: true, Volume: 0.3})
+	r.Reconcile()
+
+	if n := a.Metrics()["reconcile_drift_total"]; n != 2 {
+		t.Fatalf("reconcile_drift_total is %v, want 2", n)
+	}
+
+}
+
+func TestReconcileSendsWithoutTheLock(t *testing.T) {
+
+	//nothing reads the pipe, so the correction stays stuck in the write
+	a, remote := dialPipe(t)
+
+	a.SetSpeaker(&Speaker{LongIdentifier: "AA11BB22CC33@Kitchen", Name: "Kitchen", Connected: true, Volume: 0.5})
+
+	r := NewReconciler(a)
+
+	vol := 0.2
+	r.SetDesired(DesiredState{Speakers: map[string]DesiredSpeaker{"AA11BB22CC33@Kitchen": {Volume: &vol}}})
+
+	done := make(chan struct{})
+
+	go func() {
+		r.Reconcile()
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	read := make(chan struct{})
+
+	go func() {
+		r.Desired()
+		close(read)
+	}()
+
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("Desired blocked behind a correction")
+	}
+
+	remote.Close()
+	<-done
+
+}
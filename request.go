@@ -0,0 +1,175 @@
+package airfoilgo
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// DefaultNotifications are the notifications Subscribe asks for unless AirfoilConn.Notifications is changed
+var DefaultNotifications = []string{
+	"remoteControlChangedRequest",
+	"speakerConnectedChanged",
+	"speakerListChanged",
+	"speakerNameChanged",
+	"speakerPasswordChanged",
+	"speakerVolumeChanged",
+}
+
+// generic requests get ids well above the fixed ones used by the built in requests
+const firstRequestID = 1000
+
+// requestReply is the data of a reply, or why none is coming
+type requestReply struct {
+	data json.RawMessage
+	err  error
+}
+
+type rawRequest struct {
+	Request   string      `json:"request"`
+	RequestID string      `json:"requestID"`
+	Data      interface{} `json:"data"`
+}
+
+// Request sends any request to airfoil and returns the data of its reply,
+// this is the escape hatch for messages the library doesn't wrap. It fails with ErrConnClosed
+// when the connection goes away before the reply arrives
+func (a *AirfoilConn) Request(ctx context.Context, name string, data interface{}) (json.RawMessage, error) {
+
+	if data == nil {
+		data = struct{}{}
+	}
+
+	reply := make(chan requestReply, 1)
+
+	a.pendingLock.Lock()
+	if a.pending == nil {
+		a.pending = make(map[string]chan requestReply)
+	}
+	a.requestSeq++
+	id := strconv.Itoa(a.requestSeq + firstRequestID)
+	a.pending[id] = reply
+	a.pendingLock.Unlock()
+
+	defer func() {
+		a.pendingLock.Lock()
+		delete(a.pending, id)
+		a.pendingLock.Unlock()
+	}()
+
+	outb, err := json.Marshal(rawRequest{Request: name, RequestID: id, Data: data})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.Send(string(outb)); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-reply:
+		return r.data, r.err
+	}
+
+}
+
+// resolvePending hands a reply to the Request waiting for it
+func (a *AirfoilConn) resolvePending(response AirfoilResponse) {
+
+	if response.ReplyID == "" {
+		return
+	}
+
+	a.pendingLock.Lock()
+	reply, ok := a.pending[response.ReplyID]
+	a.pendingLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var env struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	json.Unmarshal(response.Raw, &env)
+
+	select {
+	case reply <- requestReply{data: env.Data}:
+	default:
+	}
+
+}
+
+// failPending ends every Request still waiting, their replies went out with the connection
+func (a *AirfoilConn) failPending(err error) {
+
+	a.pendingLock.Lock()
+	defer a.pendingLock.Unlock()
+
+	for id, reply := range a.pending {
+
+		select {
+		case reply <- requestReply{err: err}:
+		default:
+		}
+
+		delete(a.pending, id)
+
+	}
+
+}
+
+// connLost fails the pending Requests when q is still the live connection's queue,
+// a connection that was already replaced took its requests with it when it was closed
+func (a *AirfoilConn) connLost(q *writeQueue) {
+
+	a.connLock.Lock()
+	current := q != nil && a.queue == q
+	a.connLock.Unlock()
+
+	if current {
+		a.failPending(ErrConnClosed)
+	}
+
+}
+
+// sendRequest queues req, background polls (PriorityLow) are coalesced with an identical one still waiting
+func (a *AirfoilConn) sendRequest(req AirfoilRequest, p Priority) error {
+
+	outb, err := json.Marshal(req)
+
+	if err != nil {
+
+		return err
+
+	}
+
+	if a.status() != StateReady {
+		return ErrNotReady
+	}
+
+	key := ""
+
+	if p == PriorityLow {
+		key = string(outb)
+	}
+
+	return a.send(string(outb), p, key)
+
+}
+
+func (a *AirfoilConn) sendSubscribe() error {
+
+	notifications := a.Notifications
+
+	if notifications == nil {
+		notifications = DefaultNotifications
+	}
+
+	return a.sendRequest(AirfoilRequest{Request: "subscribe", RequestID: "3", Data: DataRequest{Notifications: notifications}}, PriorityNormal)
+
+}
@@ -0,0 +1,179 @@
+package airfoilgo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requestAsync runs a Request with a long deadline, its result arrives on the channel
+func requestAsync(a *AirfoilConn, name string) <-chan error {
+
+	done := make(chan error, 1)
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := a.Request(ctx, name, nil)
+		done <- err
+
+	}()
+
+	return done
+
+}
+
+// requestResult is what the Request came back with, well before its deadline
+func requestResult(t *testing.T, done <-chan error) error {
+
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("the request is still waiting")
+	}
+
+	return nil
+
+}
+
+func TestRequestReply(t *testing.T) {
+
+	a, remote, sent := pipeConn(t)
+
+	got := make(chan json.RawMessage, 1)
+
+	go func() {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		raw, _ := a.Request(ctx, "getAirfoilName", nil)
+		got <- raw
+
+	}()
+
+	req := nextRequest(t, sent)
+
+	notify(t, remote, `{"replyID":"`+req["requestID"].(string)+`","data":{"name":"Studio"}}`)
+
+	select {
+	case raw := <-got:
+		if string(raw) != `{"name":"Studio"}` {
+			t.Fatalf("reply data %s", raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+
+}
+
+func TestRequestFailsOnClose(t *testing.T) {
+
+	a, _, sent := pipeConn(t)
+
+	done := requestAsync(a, "getAirfoilName")
+
+	nextRequest(t, sent)
+
+	a.Close()
+
+	if err := requestResult(t, done); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("closing gave %v", err)
+	}
+
+}
+
+func TestRequestFailsWhenAirfoilHangsUp(t *testing.T) {
+
+	a, remote, sent := pipeConn(t)
+
+	done := requestAsync(a, "getAirfoilName")
+
+	nextRequest(t, sent)
+
+	remote.Close()
+
+	if err := requestResult(t, done); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("a dropped connection gave %v", err)
+	}
+
+}
+
+func TestRequestFailsOnWriteError(t *testing.T) {
+
+	a, remote := dialPipe(t, WithWriteTimeout(50*time.Millisecond))
+
+	done := requestAsync(a, "getAirfoilName")
+
+	//take the request off the wire, then stop reading so the next write times out
+	r := bufio.NewReader(remote)
+
+	head, err := r.ReadString(';')
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, _ := strconv.Atoi(strings.TrimSuffix(head, ";"))
+
+	if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Send(`{"request":"getSourceList","requestID":"9","data":{}}`); err == nil {
+		t.Fatal("a write nobody read succeeded")
+	}
+
+	if err := requestResult(t, done); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("a failed write gave %v", err)
+	}
+
+}
+
+func TestRedialKeepsNewRequests(t *testing.T) {
+
+	a, _, _ := pipeConn(t)
+
+	a.connLock.Lock()
+	old := a.queue
+	a.connLock.Unlock()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	a.DialFunc = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return local, nil
+	}
+
+	if err := a.Dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make(chan requestReply, 1)
+
+	a.pendingLock.Lock()
+	a.pending = map[string]chan requestReply{"1001": reply}
+	a.pendingLock.Unlock()
+
+	//the read loop of the replaced connection ending late
+	a.connLost(old)
+
+	select {
+	case r := <-reply:
+		t.Fatalf("a request of the new connection was failed with %v", r.err)
+	default:
+	}
+
+}
@@ -0,0 +1,504 @@
+package airfoilgo
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var ErrNotFound = errors.New("NOT_FOUND")
+
+// AmbiguousError is returned when a query matches more than one speaker or source
+type AmbiguousError struct {
+	Query      string
+	Candidates []string
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("AMBIGUOUS: %q matches %s", e.Query, strings.Join(e.Candidates, ", "))
+}
+
+// Slug is the lowercased name with spaces turned into underscores, the form used in MQTT topics
+func Slug(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "_", -1))
+}
+
+// IDSlug slugs the name part of a "MAC@Name" long identifier
+func IDSlug(id string) string {
+
+	parts := strings.SplitN(id, "@", 2)
+
+	if len(parts) > 1 {
+		return Slug(parts[1])
+	}
+
+	return Slug(id)
+
+}
+
+// SetAlias makes alias resolve to the speaker with that long identifier, name or nickname,
+// an empty target removes the alias
+func (a *AirfoilConn) SetAlias(alias string, target string) {
+
+	a.speakerLock.Lock()
+	defer a.speakerLock.Unlock()
+
+	if target == "" {
+		delete(a.aliases, strings.ToLower(alias))
+		return
+	}
+
+	a.aliases[strings.ToLower(alias)] = target
+
+}
+
+// aliasTargets is what an alias points at, a long identifier, one airfoil has since reissued,
+// or a name or nickname as aliases in the config are often written. the lock must be held
+func (a *AirfoilConn) aliasTargets(target string) []Speaker {
+
+	if spk, ok := a.speakers[target]; ok {
+		return []Speaker{spk}
+	}
+
+	if id, ok := a.renamed[target]; ok {
+
+		if spk, sok := a.speakers[id]; sok {
+			return []Speaker{spk}
+		}
+
+	}
+
+	lt := strings.ToLower(strings.TrimSpace(target))
+
+	if lt == "" {
+		return nil
+	}
+
+	var matches []Speaker
+
+	for _, spk := range a.speakers {
+
+		if strings.ToLower(spk.Name) == lt || strings.ToLower(a.nicknames[spk.LongIdentifier]) == lt {
+			matches = append(matches, spk)
+		}
+
+	}
+
+	return matches
+
+}
+
+// ResolveSpeaker finds a speaker by long identifier, alias, name or nickname, MAC prefix, slug and
+// finally a fuzzy match on the name. the first of those steps that matches anything decides,
+// more than one match there is an *AmbiguousError
+func (a *AirfoilConn) ResolveSpeaker(query string) (Speaker, error) {
+
+	q := strings.TrimSpace(query)
+
+	if q == "" {
+		return Speaker{}, ErrNotFound
+	}
+
+	a.speakerLock.RLock()
+	defer a.speakerLock.RUnlock()
+
+	if spk, ok := a.speakers[q]; ok {
+		return spk, nil
+	}
+
+	//an identifier from before airfoil renamed the speaker
+	if id, ok := a.renamed[q]; ok {
+
+		if spk, sok := a.speakers[id]; sok {
+			return spk, nil
+		}
+
+	}
+
+	lq := strings.ToLower(q)
+	nq := normalizeName(q)
+
+	if target, ok := a.aliases[lq]; ok {
+
+		matches := a.aliasTargets(target)
+
+		if len(matches) == 1 {
+			return matches[0], nil
+		}
+
+		if len(matches) > 1 {
+			return Speaker{}, ambiguous(query, matches)
+		}
+
+	}
+
+	steps := []func(spk Speaker) bool{
+		func(spk Speaker) bool {
+			return strings.ToLower(spk.Name) == lq || strings.ToLower(a.nicknames[spk.LongIdentifier]) == lq
+		},
+		//mac prefix, the hardware part of the long identifier. after the name, a speaker called "Beef"
+		//is meant even when another one's MAC starts with beef
+		func(spk Speaker) bool {
+			hw := strings.ToLower(strings.SplitN(spk.LongIdentifier, "@", 2)[0])
+			return len(lq) >= 4 && strings.Contains(spk.LongIdentifier, "@") && strings.HasPrefix(hw, lq)
+		},
+		func(spk Speaker) bool {
+			nick := a.nicknames[spk.LongIdentifier]
+			return Slug(spk.Name) == lq || IDSlug(spk.LongIdentifier) == lq || (nick != "" && Slug(nick) == lq)
+		},
+		//punctuation and spacing don't matter, "seims lappi" finds "Seim's Lappi"
+		func(spk Speaker) bool {
+			return nq != "" && (normalizeName(spk.Name) == nq || normalizeName(a.nicknames[spk.LongIdentifier]) == nq)
+		},
+		func(spk Speaker) bool {
+			return len(nq) >= 3 && (strings.Contains(normalizeName(spk.Name), nq) || strings.Contains(normalizeName(a.nicknames[spk.LongIdentifier]), nq))
+		},
+	}
+
+	for _, step := range steps {
+
+		var matches []Speaker
+
+		for _, spk := range a.speakers {
+
+			if step(spk) {
+				matches = append(matches, spk)
+			}
+
+		}
+
+		if len(matches) == 1 {
+			return matches[0], nil
+		}
+
+		if len(matches) > 1 {
+			return Speaker{}, ambiguous(query, matches)
+		}
+
+	}
+
+	//typos, closest name within a couple of edits
+	best := -1
+	var matches []Speaker
+
+	for _, spk := range a.speakers {
+
+		d := levenshtein(nq, normalizeName(spk.Name))
+
+		if nick := a.nicknames[spk.LongIdentifier]; nick != "" {
+
+			if nd := levenshtein(nq, normalizeName(nick)); nd < d {
+				d = nd
+			}
+
+		}
+
+		if d > fuzzyDistance(nq) {
+			continue
+		}
+
+		if best < 0 || d < best {
+			best = d
+			matches = nil
+		}
+
+		if d == best {
+			matches = append(matches, spk)
+		}
+
+	}
+
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+
+	if len(matches) > 1 {
+		return Speaker{}, ambiguous(query, matches)
+	}
+
+	return Speaker{}, ErrNotFound
+
+}
+
+// SetSourceAlias makes alias resolve to the source identifier, an empty identifier removes the alias
+func (a *AirfoilConn) SetSourceAlias(alias string, ident string) {
+
+	a.sourceLock.Lock()
+	defer a.sourceLock.Unlock()
+
+	if ident == "" {
+		delete(a.sourceAliases, strings.ToLower(alias))
+		return
+	}
+
+	a.sourceAliases[strings.ToLower(alias)] = ident
+
+}
+
+// ResolveSource finds a source by identifier, alias, bundle id, app name, friendly name, slug, type and
+// finally a fuzzy match on the friendly name. "type:query" only looks at sources of that type,
+// "audioDevices:usb" or "running:spotify". a type on its own, "systemAudio", matches when airfoil
+// lists a single source of that type
+func (a *AirfoilConn) ResolveSource(query string) (Source, error) {
+
+	q := strings.TrimSpace(query)
+
+	if q == "" {
+		return Source{}, ErrNotFound
+	}
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	if src, ok := a.sources[q]; ok {
+		return src, nil
+	}
+
+	lq := strings.ToLower(q)
+
+	if ident, ok := a.sourceAliases[lq]; ok {
+
+		if src, sok := a.sources[ident]; sok {
+			return src, nil
+		}
+
+	}
+
+	if ident, ok := a.bundles[lq]; ok {
+
+		if src, sok := a.sources[ident]; sok {
+			return src, nil
+		}
+
+	}
+
+	candidates := make([]Source, 0, len(a.sources))
+
+	for _, src := range a.sources {
+		candidates = append(candidates, src)
+	}
+
+	if i := strings.Index(q, ":"); i > 0 {
+
+		var scoped []Source
+
+		for _, src := range candidates {
+
+			if typeMatches(src.Type, q[:i]) {
+				scoped = append(scoped, src)
+			}
+
+		}
+
+		if len(scoped) > 0 {
+			candidates = scoped
+			q = strings.TrimSpace(q[i+1:])
+			lq = strings.ToLower(q)
+		}
+
+	}
+
+	nq := normalizeName(q)
+
+	steps := []func(src Source) bool{
+		//nothing left after the type, everything of that type
+		func(src Source) bool {
+			return q == ""
+		},
+		//identifiers are bundle ids or app paths, "com.rogueamoeba.source.systemaudio" or "Spotify.app"
+		func(src Source) bool {
+			ident := strings.ToLower(src.Identifier)
+			return ident == lq || strings.TrimSuffix(path.Base(ident), ".app") == strings.TrimSuffix(lq, ".app")
+		},
+		func(src Source) bool {
+			return strings.ToLower(src.FriendlyName) == lq
+		},
+		func(src Source) bool {
+			return Slug(src.FriendlyName) == lq
+		},
+		func(src Source) bool {
+			return nq != "" && normalizeName(src.FriendlyName) == nq
+		},
+		func(src Source) bool {
+			return typeMatches(src.Type, q)
+		},
+		func(src Source) bool {
+			return len(nq) >= 3 && strings.Contains(normalizeName(src.FriendlyName), nq)
+		},
+	}
+
+	for _, step := range steps {
+
+		var matches []Source
+
+		for _, src := range candidates {
+
+			if step(src) {
+				matches = append(matches, src)
+			}
+
+		}
+
+		if len(matches) == 1 {
+			return matches[0], nil
+		}
+
+		if len(matches) > 1 {
+			return Source{}, ambiguousSources(query, matches)
+		}
+
+	}
+
+	best := -1
+	var matches []Source
+
+	for _, src := range candidates {
+
+		d := levenshtein(nq, normalizeName(src.FriendlyName))
+
+		if d > fuzzyDistance(nq) {
+			continue
+		}
+
+		if best < 0 || d < best {
+			best = d
+			matches = nil
+		}
+
+		if d == best {
+			matches = append(matches, src)
+		}
+
+	}
+
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+
+	if len(matches) > 1 {
+		return Source{}, ambiguousSources(query, matches)
+	}
+
+	return Source{}, ErrNotFound
+
+}
+
+// typeMatches compares a source type with what a user would type for it, "system audio",
+// "system_audio" and "running" all count, a prefix needs at least four characters
+func typeMatches(typ string, q string) bool {
+
+	nt, nq := normalizeName(typ), normalizeName(q)
+
+	if nq == "" {
+		return false
+	}
+
+	return nt == nq || (len(nq) >= 4 && strings.HasPrefix(nt, nq))
+
+}
+
+func ambiguousSources(query string, matches []Source) *AmbiguousError {
+
+	e := &AmbiguousError{Query: query}
+
+	for _, src := range matches {
+		e.Candidates = append(e.Candidates, src.Identifier)
+	}
+
+	sort.Strings(e.Candidates)
+
+	return e
+
+}
+
+func ambiguous(query string, matches []Speaker) *AmbiguousError {
+
+	e := &AmbiguousError{Query: query}
+
+	for _, spk := range matches {
+		e.Candidates = append(e.Candidates, spk.LongIdentifier)
+	}
+
+	sort.Strings(e.Candidates)
+
+	return e
+
+}
+
+// lowercase letters and digits only
+func normalizeName(s string) string {
+
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(s) {
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+
+	}
+
+	return b.String()
+
+}
+
+// one typo per four characters, at most two
+func fuzzyDistance(q string) int {
+
+	d := len([]rune(q)) / 4
+
+	if d > 2 {
+		return 2
+	}
+
+	return d
+
+}
+
+func levenshtein(a string, b string) int {
+
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+
+		cur[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+
+			cost := 1
+
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+
+		}
+
+		prev, cur = cur, prev
+
+	}
+
+	return prev[len(rb)]
+
+}
+
+func minInt(x int, y int) int {
+
+	if x < y {
+		return x
+	}
+
+	return y
+
+}
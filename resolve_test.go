@@ -0,0 +1,170 @@
+package airfoilgo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResolveSpeaker(t *testing.T) {
+
+	a := NewConn("x", WithSpeakerAliases(map[string]string{
+		"downstairs": "DC9B9CEFC55C@Kitchen",
+		"laptop":     "Seim's Lappi",
+		"desk":       "study",
+		"lounge":     "Living Room",
+		"attic":      "Garage",
+		//the alias is taken over by a speaker of that name
+		"office": "Kitchen",
+	}))
+
+	for _, spk := range []Speaker{
+		{LongIdentifier: "DC9B9CEFC55C@Kitchen", Name: "Kitchen"},
+		{LongIdentifier: "BEEF00112233@Office", Name: "Office"},
+		{LongIdentifier: "0A1B2C3D4E5F@Beef", Name: "Beef"},
+		{LongIdentifier: "843835649D9C@Seim's Lappi", Name: "Seim's Lappi"},
+		{LongIdentifier: "112233445566@Living Room", Name: "Living Room"},
+		{LongIdentifier: "665544332211@Living Room", Name: "Living Room"},
+	} {
+		spk := spk
+		a.SetSpeaker(&spk)
+	}
+
+	a.SetNickname("BEEF00112233@Office", "Study")
+
+	tests := []struct {
+		query     string
+		want      string
+		ambiguous bool
+		notFound  bool
+	}{
+		{query: "DC9B9CEFC55C@Kitchen", want: "DC9B9CEFC55C@Kitchen"},
+		{query: "downstairs", want: "DC9B9CEFC55C@Kitchen"},
+		//aliases written with the name or nickname instead of the identifier
+		{query: "laptop", want: "843835649D9C@Seim's Lappi"},
+		{query: "desk", want: "BEEF00112233@Office"},
+		{query: "office", want: "DC9B9CEFC55C@Kitchen"},
+		{query: "lounge", ambiguous: true},
+		//nothing is called garage, the alias falls through to the other steps and finds nothing
+		{query: "attic", notFound: true},
+		{query: "kitchen", want: "DC9B9CEFC55C@Kitchen"},
+		{query: "dc9b", want: "DC9B9CEFC55C@Kitchen"},
+		//a name that looks like hex is the speaker with that name, not a MAC prefix
+		{query: "beef", want: "0A1B2C3D4E5F@Beef"},
+		{query: "beef0011", want: "BEEF00112233@Office"},
+		{query: "study", want: "BEEF00112233@Office"},
+		{query: "seim's_lappi", want: "843835649D9C@Seim's Lappi"},
+		{query: "seims lappi", want: "843835649D9C@Seim's Lappi"},
+		{query: "kitchn", want: "DC9B9CEFC55C@Kitchen"},
+		{query: "living room", ambiguous: true},
+		{query: "garage", notFound: true},
+		{query: " ", notFound: true},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.query, func(t *testing.T) {
+
+			spk, err := a.ResolveSpeaker(tt.query)
+
+			var amb *AmbiguousError
+
+			switch {
+			case tt.ambiguous:
+				if !errors.As(err, &amb) {
+					t.Fatalf("want an ambiguous error, got %v", err)
+				}
+			case tt.notFound:
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("want not found, got %v", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case spk.LongIdentifier != tt.want:
+				t.Fatalf("got %s, want %s", spk.LongIdentifier, tt.want)
+			}
+
+		})
+
+	}
+
+}
+
+func TestResolveSource(t *testing.T) {
+
+	a := NewConn("x", WithSourceAliases(map[string]string{"tunes": "/Applications/Music.app"}))
+
+	a.applyCatalog(SourceCatalog{Categories: []SourceCategory{
+		{Type: SourceTypeRunningApplications, Sources: []Source{
+			{Identifier: "com.spotify.client", FriendlyName: "Spotify", Type: SourceTypeRunningApplications},
+			{Identifier: "/Applications/Music.app", FriendlyName: "Music", Type: SourceTypeRunningApplications},
+		}},
+		{Type: SourceTypeRecentApplications, Sources: []Source{
+			{Identifier: "com.apple.Safari", FriendlyName: "Safari", Type: SourceTypeRecentApplications},
+		}},
+		{Type: SourceTypeAudioDevices, Sources: []Source{
+			{Identifier: "AppleUSBAudioEngine:1", FriendlyName: "USB Audio CODEC", Type: SourceTypeAudioDevices},
+			{Identifier: "AppleUSBAudioEngine:2", FriendlyName: "USB Mic", Type: SourceTypeAudioDevices},
+		}},
+		{Type: SourceTypeSystemAudio, Sources: []Source{
+			{Identifier: "com.rogueamoeba.source.systemaudio", FriendlyName: "System-Wide Audio", Type: SourceTypeSystemAudio},
+		}},
+	}})
+
+	//only learnt from the metadata of the active source
+	a.learnBundle("com.apple.Music", "/Applications/Music.app")
+
+	tests := []struct {
+		query     string
+		want      string
+		ambiguous []string
+		notFound  bool
+	}{
+		{query: "com.spotify.client", want: "com.spotify.client"},
+		{query: "spotify", want: "com.spotify.client"},
+		{query: "tunes", want: "/Applications/Music.app"},
+		{query: "com.apple.music", want: "/Applications/Music.app"},
+		{query: "Music.app", want: "/Applications/Music.app"},
+		{query: "system-wide_audio", want: "com.rogueamoeba.source.systemaudio"},
+		{query: "systemAudio", want: "com.rogueamoeba.source.systemaudio"},
+		{query: "running:spotify", want: "com.spotify.client"},
+		{query: "runningApplications:music", want: "/Applications/Music.app"},
+		{query: "recent:spotify", notFound: true},
+		{query: "audioDevices:mic", want: "AppleUSBAudioEngine:2"},
+		{query: "audioDevices:usb", ambiguous: []string{"AppleUSBAudioEngine:1", "AppleUSBAudioEngine:2"}},
+		{query: "usb", ambiguous: []string{"AppleUSBAudioEngine:1", "AppleUSBAudioEngine:2"}},
+		{query: "audioDevices", ambiguous: []string{"AppleUSBAudioEngine:1", "AppleUSBAudioEngine:2"}},
+		{query: "usb audio", want: "AppleUSBAudioEngine:1"},
+		{query: "spotfy", want: "com.spotify.client"},
+		{query: "garageband", notFound: true},
+		{query: " ", notFound: true},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.query, func(t *testing.T) {
+
+			src, err := a.ResolveSource(tt.query)
+
+			var amb *AmbiguousError
+
+			switch {
+			case tt.ambiguous != nil:
+				if !errors.As(err, &amb) || strings.Join(amb.Candidates, ",") != strings.Join(tt.ambiguous, ",") {
+					t.Fatalf("want ambiguous between %v, got %v", tt.ambiguous, err)
+				}
+			case tt.notFound:
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("want not found, got %+v, %v", src, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case src.Identifier != tt.want:
+				t.Fatalf("got %s, want %s", src.Identifier, tt.want)
+			}
+
+		})
+
+	}
+
+}
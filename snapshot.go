@@ -0,0 +1,268 @@
+package airfoilgo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is where the session is in its lifecycle
+type ConnState int32
+
+const (
+	StateDisconnected ConnState = iota
+	StateDialing
+	StateHandshake
+	StateReady
+)
+
+func (s ConnState) String() string {
+
+	switch s {
+	case StateDialing:
+		return "dialing"
+	case StateHandshake:
+		return "handshake"
+	case StateReady:
+		return "ready"
+	}
+
+	return "disconnected"
+
+}
+
+func (s ConnState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText takes the names String gives, so a Snapshot read back from json keeps its state
+func (s *ConnState) UnmarshalText(text []byte) error {
+
+	for _, st := range []ConnState{StateDisconnected, StateDialing, StateHandshake, StateReady} {
+
+		if st.String() == string(text) {
+			*s = st
+			return nil
+		}
+
+	}
+
+	return fmt.Errorf("unknown connection state %q", text)
+
+}
+
+const (
+	EventNowPlaying   EventType = "nowPlaying"
+	EventStateChanged EventType = "stateChanged" //data is the new ConnState
+)
+
+// NowPlaying is the latest getSourceMetadata reply
+type NowPlaying struct {
+	Title                  string `json:"title,omitempty"`
+	Artist                 string `json:"artist,omitempty"`
+	Album                  string `json:"album,omitempty"`
+	AlbumArt               string `json:"albumArt,omitempty"`
+	SourceName             string `json:"sourceName,omitempty"`
+	BundleID               string `json:"bundleid,omitempty"`
+	Icon                   string `json:"icon,omitempty"`
+	MachineName            string `json:"machineName,omitempty"`
+	MachineModel           string `json:"machineModel,omitempty"`
+	RemoteControlAvailable bool   `json:"remoteControlAvailable"`
+	TrackMetadataAvailable bool   `json:"trackMetadataAvailable"`
+}
+
+// Snapshot is a deep copy of the library state, safe to keep and range over.
+// Version goes up on every change so callers can tell whether anything moved
+type Snapshot struct {
+	Version               uint64              `json:"version"`
+	Time                  time.Time           `json:"time"`
+	State                 ConnState           `json:"state"`
+	Address               string              `json:"address"`
+	Speakers              []Speaker           `json:"speakers"`
+	Sources               map[string][]Source `json:"sources"`
+	ActiveSource          Source              `json:"activeSource"`
+	ActiveSourceChangedAt time.Time           `json:"activeSourceChangedAt"`
+	ActiveSourceChangedBy string              `json:"activeSourceChangedBy,omitempty"`
+	NowPlaying            NowPlaying          `json:"nowPlaying"`
+}
+
+// Snapshot returns the current state, speakers sorted by name and sources grouped by type in airfoil's order
+func (a *AirfoilConn) Snapshot() Snapshot {
+
+	snap := Snapshot{
+		Version: a.Version(),
+		Time:    time.Now(),
+		State:   a.status(),
+		Address: a.Address,
+		Sources: make(map[string][]Source),
+	}
+
+	a.speakerLock.RLock()
+
+	snap.Speakers = make([]Speaker, 0, len(a.speakers))
+
+	for _, spk := range a.speakers {
+		snap.Speakers = append(snap.Speakers, spk)
+	}
+
+	a.speakerLock.RUnlock()
+
+	sort.Slice(snap.Speakers, func(i, j int) bool {
+
+		ni, nj := strings.ToLower(snap.Speakers[i].Name), strings.ToLower(snap.Speakers[j].Name)
+
+		if ni == nj {
+			return snap.Speakers[i].LongIdentifier < snap.Speakers[j].LongIdentifier
+		}
+
+		return ni < nj
+
+	})
+
+	a.sourceLock.RLock()
+
+	for _, cg := range a.catalog.Categories {
+		snap.Sources[cg.Type] = append([]Source(nil), cg.Sources...)
+	}
+
+	snap.ActiveSource = a.activeChange.Source
+	snap.ActiveSourceChangedAt = a.activeChange.ChangedAt
+	snap.ActiveSourceChangedBy = a.activeChange.ChangedBy
+	snap.NowPlaying = a.nowPlaying
+
+	a.sourceLock.RUnlock()
+
+	return snap
+
+}
+
+// Version is bumped whenever speakers, sources, now playing or the connection state change
+func (a *AirfoilConn) Version() uint64 {
+	return atomic.LoadUint64(&a.version)
+}
+
+func (a *AirfoilConn) bump() {
+	atomic.AddUint64(&a.version, 1)
+}
+
+func (a *AirfoilConn) State() ConnState {
+	return a.status()
+}
+
+// Ready is true once the handshake is done and requests can be sent
+func (a *AirfoilConn) Ready() bool {
+	return a.status() == StateReady
+}
+
+func (a *AirfoilConn) status() ConnState {
+	return ConnState(atomic.LoadInt32(&a.state))
+}
+
+func (a *AirfoilConn) setStatus(s ConnState) {
+
+	//a new session has to subscribe again
+	if s != StateReady {
+		atomic.StoreInt32(&a.subscribed, 0)
+	}
+
+	if ConnState(atomic.SwapInt32(&a.state, int32(s))) != s {
+		a.bump()
+		a.emit(Event{Type: EventStateChanged, Data: s})
+	}
+
+}
+
+// Speakers returns a copy of the speakers keyed by LongIdentifier
+func (a *AirfoilConn) Speakers() map[string]Speaker {
+
+	a.speakerLock.RLock()
+	defer a.speakerLock.RUnlock()
+
+	out := make(map[string]Speaker, len(a.speakers))
+
+	for id, spk := range a.speakers {
+		out[id] = spk
+	}
+
+	return out
+
+}
+
+// Sources returns a copy of the sources keyed by Identifier
+func (a *AirfoilConn) Sources() map[string]Source {
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	out := make(map[string]Source, len(a.sources))
+
+	for id, src := range a.sources {
+		out[id] = src
+	}
+
+	return out
+
+}
+
+func (a *AirfoilConn) ActiveSource() Source {
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	return a.activeChange.Source
+
+}
+
+func (a *AirfoilConn) NowPlaying() NowPlaying {
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	return a.nowPlaying
+
+}
+
+func (a *AirfoilConn) setNowPlaying(md RequestedData) {
+
+	np := NowPlaying{
+		Title:        metaString(md.Title),
+		Artist:       metaString(md.Artist),
+		Album:        metaString(md.Album),
+		AlbumArt:     metaString(md.AlbumArt),
+		SourceName:   metaString(md.SourceName),
+		BundleID:     metaString(md.Bundleid),
+		Icon:         metaString(md.Icon),
+		MachineName:  metaString(md.MachineName),
+		MachineModel: metaString(md.MachineModel),
+	}
+
+	np.RemoteControlAvailable = md.RemoteControlAvailable
+	np.TrackMetadataAvailable, _ = md.TrackMetadataAvailable.(bool)
+
+	a.sourceLock.Lock()
+	a.nowPlaying = np
+	a.sourceLock.Unlock()
+
+	a.bump()
+
+	a.emit(Event{Type: EventNowPlaying, Data: np})
+
+}
+
+// metadata replies reuse the request fields, so they can be anything
+func metaString(v interface{}) string {
+
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case bool:
+		return ""
+	}
+
+	return fmt.Sprint(v)
+
+}
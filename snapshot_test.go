@@ -0,0 +1,32 @@
+package airfoilgo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConnStateText(t *testing.T) {
+
+	for _, st := range []ConnState{StateDisconnected, StateDialing, StateHandshake, StateReady} {
+
+		b, err := json.Marshal(Health{State: st})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var h Health
+
+		if err := json.Unmarshal(b, &h); err != nil || h.State != st {
+			t.Fatalf("%s came back as %s, %v", st, h.State, err)
+		}
+
+	}
+
+	var st ConnState
+
+	if err := st.UnmarshalText([]byte("connected")); err == nil {
+		t.Fatal("an unknown state was accepted")
+	}
+
+}
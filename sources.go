@@ -0,0 +1,342 @@
+package airfoilgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	EventSourceAdded   EventType = "sourceAdded"
+	EventSourceRemoved EventType = "sourceRemoved"
+)
+
+// the categories airfoil groups its sources under
+const (
+	SourceTypeRunningApplications = "runningApplications"
+	SourceTypeRecentApplications  = "recentApplications"
+	SourceTypeAudioDevices        = "audioDevices"
+	SourceTypeSystemAudio         = "systemAudio"
+)
+
+// SourceCategory is one group of the getSourceList reply
+type SourceCategory struct {
+	Type    string   `json:"type"`
+	Sources []Source `json:"sources"`
+}
+
+// SourceCatalog is the source list as airfoil sent it, categories and the sources in them keep their order
+type SourceCatalog struct {
+	Categories []SourceCategory `json:"categories"`
+}
+
+// DecodeSourceCatalog reads the data of a getSourceList reply, a plain map would lose the category order
+func DecodeSourceCatalog(data []byte) (SourceCatalog, error) {
+
+	var cat SourceCatalog
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return cat, fmt.Errorf("source list is not an object")
+	}
+
+	for dec.More() {
+
+		tok, err := dec.Token()
+
+		if err != nil {
+			return cat, err
+		}
+
+		typ, _ := tok.(string)
+
+		var items []Source
+
+		if err := dec.Decode(&items); err != nil {
+			return cat, err
+		}
+
+		for i := range items {
+			items[i].Type = typ
+		}
+
+		cat.Categories = append(cat.Categories, SourceCategory{Type: typ, Sources: items})
+
+	}
+
+	cat.markRunning()
+
+	return cat, nil
+
+}
+
+// All lists every source once in airfoil's order, an app that is both running and recent
+// is listed where it first appears
+func (c SourceCatalog) All() []Source {
+
+	seen := make(map[string]bool)
+	var out []Source
+
+	for _, cg := range c.Categories {
+
+		for _, src := range cg.Sources {
+
+			if seen[src.Identifier] {
+				continue
+			}
+
+			seen[src.Identifier] = true
+			out = append(out, src)
+
+		}
+
+	}
+
+	return out
+
+}
+
+// Category returns the sources of one type, nil when airfoil didn't list it
+func (c SourceCatalog) Category(typ string) []Source {
+
+	for _, cg := range c.Categories {
+
+		if cg.Type == typ {
+			return append([]Source(nil), cg.Sources...)
+		}
+
+	}
+
+	return nil
+
+}
+
+// Running lists the applications airfoil reports as running
+func (c SourceCatalog) Running() []Source {
+	return c.Category(SourceTypeRunningApplications)
+}
+
+func (c SourceCatalog) Lookup(ident string) (Source, bool) {
+
+	for _, cg := range c.Categories {
+
+		for _, src := range cg.Sources {
+
+			if src.Identifier == ident {
+				return src, true
+			}
+
+		}
+
+	}
+
+	return Source{}, false
+
+}
+
+// flag running apps wherever they are listed, so a recent application shows whether it is open
+func (c *SourceCatalog) markRunning() {
+
+	running := make(map[string]bool)
+
+	for _, src := range c.Running() {
+		running[src.Identifier] = true
+	}
+
+	for ci := range c.Categories {
+
+		for si := range c.Categories[ci].Sources {
+			c.Categories[ci].Sources[si].Running = running[c.Categories[ci].Sources[si].Identifier]
+		}
+
+	}
+
+}
+
+func (c SourceCatalog) copy() SourceCatalog {
+
+	out := SourceCatalog{Categories: make([]SourceCategory, len(c.Categories))}
+
+	for i, cg := range c.Categories {
+		out.Categories[i] = SourceCategory{Type: cg.Type, Sources: append([]Source(nil), cg.Sources...)}
+	}
+
+	return out
+
+}
+
+// catalogFromSources rebuilds a catalog from sources without an order, types and names are sorted
+func catalogFromSources(list []Source) SourceCatalog {
+
+	var cat SourceCatalog
+	index := make(map[string]int)
+
+	sort.Slice(list, func(i, j int) bool {
+
+		if list[i].Type == list[j].Type {
+			return strings.ToLower(list[i].FriendlyName) < strings.ToLower(list[j].FriendlyName)
+		}
+
+		return list[i].Type < list[j].Type
+
+	})
+
+	for _, src := range list {
+
+		i, ok := index[src.Type]
+
+		if !ok {
+			i = len(cat.Categories)
+			index[src.Type] = i
+			cat.Categories = append(cat.Categories, SourceCategory{Type: src.Type})
+		}
+
+		cat.Categories[i].Sources = append(cat.Categories[i].Sources, src)
+
+	}
+
+	return cat
+
+}
+
+// Catalog returns a copy of the source list grouped and ordered the way airfoil sent it
+func (a *AirfoilConn) Catalog() SourceCatalog {
+
+	a.sourceLock.RLock()
+	defer a.sourceLock.RUnlock()
+
+	return a.catalog.copy()
+
+}
+
+// applyCatalog replaces the known sources with a fresh getSourceList reply,
+// whatever is missing from it is gone
+func (a *AirfoilConn) applyCatalog(cat SourceCatalog) {
+
+	all := cat.All()
+	index := make(map[string]Source, len(all))
+
+	for _, src := range all {
+		index[src.Identifier] = src
+	}
+
+	a.sourceLock.Lock()
+	old := a.sources
+	a.sources = index
+	a.catalog = cat
+	a.sourceLock.Unlock()
+
+	var events []Event
+
+	for _, src := range all {
+
+		if _, ok := old[src.Identifier]; !ok {
+			events = append(events, Event{Type: EventSourceAdded, Source: src.Identifier, Data: src})
+		}
+
+	}
+
+	for id, src := range old {
+
+		if _, ok := index[id]; !ok {
+			events = append(events, Event{Type: EventSourceRemoved, Source: id, Data: src})
+		}
+
+	}
+
+	a.bump()
+	a.persist()
+
+	for _, ev := range events {
+		a.emit(ev)
+	}
+
+	//the metadata named a source we didn't know yet, it should match now
+	if active := a.ActiveSource(); active.Identifier == "" && active.FriendlyName != "" {
+		a.FetchMetadata()
+	}
+
+}
+
+// RefreshSources asks airfoil for the source list and waits until it has been applied,
+// unlike FetchSources which only queues the request
+func (a *AirfoilConn) RefreshSources(ctx context.Context) error {
+
+	raw, err := a.Request(ctx, "getSourceList", DataRequest{IconSize: a.SourceIconSize, ScaleFactor: a.SourceScale})
+
+	if err != nil {
+		return err
+	}
+
+	cat, err := DecodeSourceCatalog(raw)
+
+	if err != nil {
+		return err
+	}
+
+	a.applyCatalog(cat)
+
+	return nil
+
+}
+
+// SelectSource resolves query with ResolveSource and makes it the active source, when nothing
+// matches the source list is refreshed once before giving up, so apps launched since the last
+// fetch can be picked straight away
+func (a *AirfoilConn) SelectSource(ctx context.Context, query string) (Source, error) {
+
+	src, err := a.findSource(ctx, query)
+
+	if err != nil {
+		return Source{}, err
+	}
+
+	return src, a.SetSource(src.Identifier)
+
+}
+
+// SelectSourceAndWait is SelectSource followed by waiting for airfoil to report it as active
+func (a *AirfoilConn) SelectSourceAndWait(ctx context.Context, query string) (Source, error) {
+
+	src, err := a.findSource(ctx, query)
+
+	if err != nil {
+		return Source{}, err
+	}
+
+	return src, a.SetSourceAndWait(ctx, src.Identifier)
+
+}
+
+func (a *AirfoilConn) findSource(ctx context.Context, query string) (Source, error) {
+
+	src, err := a.ResolveSource(query)
+
+	if errors.Is(err, ErrNotFound) {
+
+		if rerr := a.RefreshSources(ctx); rerr != nil {
+			return Source{}, rerr
+		}
+
+		src, err = a.ResolveSource(query)
+
+	}
+
+	return src, err
+
+}
+
+// learnBundle remembers which source a bundle id belongs to, airfoil only tells us in the metadata
+// of the active source
+func (a *AirfoilConn) learnBundle(bundleID string, ident string) {
+
+	a.sourceLock.Lock()
+	a.bundles[strings.ToLower(bundleID)] = ident
+	a.sourceLock.Unlock()
+
+}
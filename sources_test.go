@@ -0,0 +1,148 @@
+package airfoilgo
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+
+	t.Helper()
+
+	b, err := os.ReadFile("testdata/" + name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+
+}
+
+func TestDecodeSourceCatalog(t *testing.T) {
+
+	cat, err := DecodeSourceCatalog(readFixture(t, "getSourceList.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+
+	for _, cg := range cat.Categories {
+		types = append(types, cg.Type)
+	}
+
+	//airfoil's order, not the alphabetical one a map would give
+	if got := strings.Join(types, ","); got != "recentApplications,runningApplications,audioDevices,systemAudio" {
+		t.Fatalf("categories in order %s", got)
+	}
+
+	recent := cat.Category(SourceTypeRecentApplications)
+
+	if len(recent) != 2 || recent[0].FriendlyName != "Spotify" || recent[1].FriendlyName != "Safari" {
+		t.Fatalf("recent applications %+v", recent)
+	}
+
+	for _, src := range recent {
+
+		if src.Type != SourceTypeRecentApplications {
+			t.Fatalf("%s has type %q", src.FriendlyName, src.Type)
+		}
+
+	}
+
+	//a recent app that is also running says so
+	if !recent[0].Running || recent[1].Running {
+		t.Fatalf("running flags on recent applications %+v", recent)
+	}
+
+	for _, src := range cat.Running() {
+
+		if !src.Running {
+			t.Fatalf("%s is listed as running but not flagged", src.FriendlyName)
+		}
+
+	}
+
+	if dev := cat.Category(SourceTypeAudioDevices); len(dev) != 1 || dev[0].Running {
+		t.Fatalf("audio devices %+v", dev)
+	}
+
+	var all []string
+
+	for _, src := range cat.All() {
+		all = append(all, src.FriendlyName)
+	}
+
+	//Spotify only once, where it first appears
+	if got := strings.Join(all, ","); got != "Spotify,Safari,Music,USB Audio CODEC,System-Wide Audio" {
+		t.Fatalf("All() is %s", got)
+	}
+
+	if _, err := DecodeSourceCatalog([]byte(`["not","an","object"]`)); err == nil {
+		t.Fatal("an array was accepted")
+	}
+
+}
+
+func TestSourceListEvents(t *testing.T) {
+
+	a, remote, _ := pipeConn(t)
+
+	got := make(chan Event, 32)
+
+	a.Listen(func(ev Event) {
+
+		if ev.Type == EventSourceAdded || ev.Type == EventSourceRemoved {
+			got <- ev
+		}
+
+	})
+
+	reply := func(fixture string) []string {
+
+		notify(t, remote, `{"replyID":"9","data":`+string(readFixture(t, fixture))+`}`)
+
+		var events []string
+
+		for {
+
+			select {
+			case ev := <-got:
+				events = append(events, string(ev.Type)+" "+ev.Source)
+			case <-time.After(200 * time.Millisecond):
+				sort.Strings(events)
+				return events
+			}
+
+		}
+
+	}
+
+	first := reply("getSourceList.json")
+
+	if len(first) != 5 {
+		t.Fatalf("first list emitted %v", first)
+	}
+
+	//the same list again changes nothing
+	if again := reply("getSourceList.json"); len(again) != 0 {
+		t.Fatalf("an unchanged list emitted %v", again)
+	}
+
+	//Safari dropped out of the recent apps, Chrome was started
+	changed := reply("getSourceList-changed.json")
+
+	if got := strings.Join(changed, ","); got != "sourceAdded com.google.Chrome,sourceRemoved com.apple.Safari" {
+		t.Fatalf("changed list emitted %s", got)
+	}
+
+	if types := a.Catalog().Categories; len(types) != 4 || types[0].Type != SourceTypeRecentApplications {
+		t.Fatalf("catalog order lost %+v", types)
+	}
+
+}
@@ -0,0 +1,219 @@
+package airfoilgo
+
+import (
+	"strings"
+)
+
+const (
+	EventSpeakerAdded   EventType = "speakerAdded"
+	EventSpeakerRemoved EventType = "speakerRemoved"
+	EventSpeakerRenamed EventType = "speakerRenamed"
+	EventSpeakerChanged EventType = "speakerChanged" //connected or volume changed
+)
+
+// SpeakerRename is the data of an EventSpeakerRenamed, OldID differs from the
+// new LongIdentifier when airfoil reissued the identifier with the new name
+type SpeakerRename struct {
+	OldID   string  `json:"oldId"`
+	OldName string  `json:"oldName"`
+	Speaker Speaker `json:"speaker"`
+}
+
+// applySpeakerList replaces the speaker map with a fresh list from airfoil and emits what changed
+func (a *AirfoilConn) applySpeakerList(list []Speaker) {
+
+	var events []Event
+
+	fresh := make(map[string]Speaker, len(list))
+
+	for _, spk := range list {
+		fresh[spk.LongIdentifier] = spk
+	}
+
+	a.speakerLock.Lock()
+
+	removed := make(map[string]Speaker)
+
+	for id, old := range a.speakers {
+
+		if _, ok := fresh[id]; !ok {
+			removed[id] = old
+		}
+
+	}
+
+	for _, spk := range list {
+
+		old, ok := a.speakers[spk.LongIdentifier]
+
+		if ok {
+
+			if old.Name != spk.Name {
+				events = append(events, Event{Type: EventSpeakerRenamed, Speaker: spk.LongIdentifier, Data: SpeakerRename{OldID: old.LongIdentifier, OldName: old.Name, Speaker: spk}})
+			}
+
+			continue
+
+		}
+
+		//same device under a new "MAC@Name" identifier is a rename, not a new speaker
+		if prev, pok := removed[renamedFrom(spk.LongIdentifier, removed)]; pok {
+
+			delete(removed, prev.LongIdentifier)
+			a.moveSpeakerSettings(prev.LongIdentifier, spk.LongIdentifier)
+
+			events = append(events, Event{Type: EventSpeakerRenamed, Speaker: spk.LongIdentifier, Data: SpeakerRename{OldID: prev.LongIdentifier, OldName: prev.Name, Speaker: spk}})
+			continue
+
+		}
+
+		events = append(events, Event{Type: EventSpeakerAdded, Speaker: spk.LongIdentifier, Data: spk})
+
+	}
+
+	for id, old := range removed {
+		events = append(events, Event{Type: EventSpeakerRemoved, Speaker: id, Data: old})
+	}
+
+	a.speakers = fresh
+
+	for id, spk := range fresh {
+
+		if spk.Volume > 0 {
+			a.volumes[id] = spk.Volume
+		}
+
+	}
+
+	a.speakerLock.Unlock()
+
+	a.bump()
+
+	for _, ev := range events {
+		a.emit(ev)
+	}
+
+}
+
+// renameSpeaker handles speakerNameChanged
+func (a *AirfoilConn) renameSpeaker(id string, name string) {
+
+	if name == "" {
+		return
+	}
+
+	a.speakerLock.Lock()
+
+	spk, ok := a.speakers[id]
+
+	if !ok || spk.Name == name {
+		a.speakerLock.Unlock()
+		return
+	}
+
+	old := spk.Name
+	spk.Name = name
+	a.speakers[id] = spk
+
+	a.speakerLock.Unlock()
+
+	a.bump()
+
+	a.emit(Event{Type: EventSpeakerRenamed, Speaker: id, Data: SpeakerRename{OldID: id, OldName: old, Speaker: spk}})
+
+}
+
+// updateSpeaker changes the cached speaker in place under the lock. with per speaker dispatch a list
+// can be applied on another worker at the same time, a copy written back would undo it. false when
+// the speaker isn't in the list
+func (a *AirfoilConn) updateSpeaker(id string, change func(spk *Speaker)) (Speaker, bool) {
+
+	a.speakerLock.Lock()
+
+	spk, ok := a.speakers[id]
+
+	if !ok {
+		a.speakerLock.Unlock()
+		return spk, false
+	}
+
+	change(&spk)
+	a.speakers[id] = spk
+
+	if !spk.Stale && spk.Volume > 0 {
+		a.volumes[id] = spk.Volume
+	}
+
+	a.speakerLock.Unlock()
+
+	a.bump()
+
+	return spk, true
+
+}
+
+// renamedFrom finds the removed speaker sharing the hardware part of id, "" if there is none. two
+// removed speakers with that hardware part can't tell which one it was, that is no rename either
+func renamedFrom(id string, removed map[string]Speaker) string {
+
+	parts := strings.SplitN(id, "@", 2)
+
+	if len(parts) < 2 || parts[0] == "" {
+		return ""
+	}
+
+	found := ""
+
+	for rid := range removed {
+
+		if strings.HasPrefix(rid, parts[0]+"@") {
+
+			if found != "" {
+				return ""
+			}
+
+			found = rid
+
+		}
+
+	}
+
+	return found
+
+}
+
+// moveSpeakerSettings carries what was kept for a speaker over to its new identifier. the old one
+// keeps resolving to the new one, so desired state and config naming it still find the speaker.
+// call with speakerLock held
+func (a *AirfoilConn) moveSpeakerSettings(from string, to string) {
+
+	if nick, ok := a.nicknames[from]; ok {
+		a.nicknames[to] = nick
+		delete(a.nicknames, from)
+	}
+
+	if vol, ok := a.volumes[from]; ok {
+		a.volumes[to] = vol
+		delete(a.volumes, from)
+	}
+
+	for alias, id := range a.aliases {
+
+		if id == from {
+			a.aliases[alias] = to
+		}
+
+	}
+
+	for old, id := range a.renamed {
+
+		if id == from {
+			a.renamed[old] = to
+		}
+
+	}
+
+	a.renamed[from] = to
+	delete(a.renamed, to)
+
+}
@@ -0,0 +1,251 @@
+package airfoilgo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"testing"
+	"time"
+)
+
+func TestPerSpeakerDispatchKeepsTheList(t *testing.T) {
+
+	a, remote, _ := pipeConn(t, WithDispatch(DispatchPerSpeaker, 4))
+
+	list := func(ids ...string) string {
+
+		var spks string
+
+		for i, id := range ids {
+
+			if i > 0 {
+				spks += ","
+			}
+
+			spks += fmt.Sprintf(`{"longIdentifier":"%s","name":"%s","connected":true,"volume":0.5}`, id, id)
+
+		}
+
+		return fmt.Sprintf(`{"request":"speakerListChanged","data":{"speakers":[%s]}}`, spks)
+
+	}
+
+	//a volume change for a speaker on another worker than the lists
+	other := func(i int) string {
+
+		for n := 0; ; n++ {
+
+			id := fmt.Sprintf("%02X%02X00000000@Gone", i, n)
+
+			h := fnv.New32a()
+			h.Write([]byte(id))
+
+			if h.Sum32()%4 != 0 {
+				return id
+			}
+
+		}
+
+	}
+
+	for i := 0; i < 10; i++ {
+
+		gone := other(i)
+
+		notify(t, remote, list("AABBCCDDEEFF@Stays", gone))
+		waitSpeakers(t, a, 2)
+
+		//both frames wait on the lock, the volume change copied the speaker before the list goes
+		a.speakerLock.Lock()
+
+		notify(t, remote, fmt.Sprintf(`{"request":"speakerVolumeChanged","data":{"longIdentifier":"%s","volume":0.3}}`, gone))
+		notify(t, remote, list("AABBCCDDEEFF@Stays"))
+		time.Sleep(20 * time.Millisecond)
+
+		a.speakerLock.Unlock()
+
+		waitSpeakers(t, a, 1)
+		time.Sleep(20 * time.Millisecond)
+
+		if spks := a.Snapshot().Speakers; len(spks) != 1 || spks[0].LongIdentifier != "AABBCCDDEEFF@Stays" {
+			t.Fatalf("round %d: %s came back after it was removed", i, gone)
+		}
+
+	}
+
+}
+
+// waitSpeakers waits for the list to have n speakers
+func waitSpeakers(t *testing.T, a *AirfoilConn, n int) {
+
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for len(a.Snapshot().Speakers) != n {
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%d speakers, want %d", len(a.Snapshot().Speakers), n)
+		}
+
+		time.Sleep(time.Millisecond)
+
+	}
+
+}
+
+// listEvents collects the speaker list events emitted while fn runs
+func listEvents(t *testing.T, a *AirfoilConn, fn func()) []Event {
+
+	t.Helper()
+
+	got := make(chan Event, 16)
+
+	cancel := a.Listen(func(ev Event) {
+
+		switch ev.Type {
+		case EventSpeakerAdded, EventSpeakerRemoved, EventSpeakerRenamed:
+			got <- ev
+		}
+
+	})
+
+	defer cancel()
+
+	fn()
+
+	var out []Event
+
+	for {
+
+		select {
+		case ev := <-got:
+			out = append(out, ev)
+		case <-time.After(100 * time.Millisecond):
+			return out
+		}
+
+	}
+
+}
+
+func TestSpeakerRenameMovesSettings(t *testing.T) {
+
+	a, _, sent := pipeConn(t, WithSpeakerAliases(map[string]string{"downstairs": "AA11BB22CC33@Kitchen"}))
+
+	a.applySpeakerList([]Speaker{{LongIdentifier: "AA11BB22CC33@Kitchen", Name: "Kitchen", Connected: true, Volume: 0.6}})
+	a.SetNickname("AA11BB22CC33@Kitchen", "Cucina")
+
+	r := NewReconciler(a)
+
+	quiet := 0.3
+	r.SetDesired(DesiredState{Speakers: map[string]DesiredSpeaker{"AA11BB22CC33@Kitchen": {Volume: &quiet}}})
+
+	//airfoil reissues the identifier with the new name, the volume is down at 0 meanwhile
+	events := listEvents(t, a, func() {
+		a.applySpeakerList([]Speaker{{LongIdentifier: "AA11BB22CC33@Cuisine", Name: "Cuisine", Connected: true}})
+	})
+
+	if len(events) != 1 || events[0].Type != EventSpeakerRenamed || events[0].Data.(SpeakerRename).OldID != "AA11BB22CC33@Kitchen" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	for _, q := range []string{"downstairs", "cucina", "AA11BB22CC33@Kitchen"} {
+
+		if spk, err := a.ResolveSpeaker(q); err != nil || spk.LongIdentifier != "AA11BB22CC33@Cuisine" {
+			t.Fatalf("%s resolves to %+v, %v", q, spk, err)
+		}
+
+	}
+
+	if got := masterTargets(a.speakers, a.volumes, 0.5); got["AA11BB22CC33@Cuisine"] != 0.5 {
+		t.Fatalf("remembered volume lost: %v", got)
+	}
+
+	drifts := r.Reconcile()
+
+	if len(drifts) != 1 || drifts[0].Speaker != "AA11BB22CC33@Cuisine" {
+		t.Fatalf("desired state didn't follow: %+v", drifts)
+	}
+
+	if req := nextRequest(t, sent); req["data"].(map[string]interface{})["longIdentifier"] != "AA11BB22CC33@Cuisine" {
+		t.Fatalf("correction sent to %v", req)
+	}
+
+}
+
+func TestSpeakerRemovedIsNoRename(t *testing.T) {
+
+	a := NewConn("x", WithSpeakerAliases(map[string]string{"downstairs": "AA11BB22CC33@Kitchen"}))
+
+	a.applySpeakerList([]Speaker{{LongIdentifier: "AA11BB22CC33@Kitchen", Name: "Kitchen", Volume: 0.6}})
+	a.SetNickname("AA11BB22CC33@Kitchen", "Cucina")
+
+	events := listEvents(t, a, func() {
+		a.applySpeakerList([]Speaker{{LongIdentifier: "DD44EE55FF66@Office", Name: "Office"}})
+	})
+
+	types := map[EventType]string{}
+
+	for _, ev := range events {
+		types[ev.Type] = ev.Speaker
+	}
+
+	if len(events) != 2 || types[EventSpeakerRemoved] != "AA11BB22CC33@Kitchen" || types[EventSpeakerAdded] != "DD44EE55FF66@Office" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	for _, q := range []string{"downstairs", "cucina", "AA11BB22CC33@Kitchen"} {
+
+		if spk, err := a.ResolveSpeaker(q); err == nil {
+			t.Fatalf("%s resolves to %s", q, spk.LongIdentifier)
+		}
+
+	}
+
+	if _, ok := a.volumes["DD44EE55FF66@Office"]; ok {
+		t.Fatal("the removed speaker's volume moved to the new one")
+	}
+
+}
+
+func TestSpeakerPrefixCollision(t *testing.T) {
+
+	a := NewConn("x")
+
+	a.applySpeakerList([]Speaker{
+		{LongIdentifier: "AA11BB22CC33@One", Name: "One", Volume: 0.2},
+		{LongIdentifier: "AA11BB22CC33@Two", Name: "Two", Volume: 0.8},
+	})
+
+	//either could have become Three, so neither did
+	events := listEvents(t, a, func() {
+		a.applySpeakerList([]Speaker{{LongIdentifier: "AA11BB22CC33@Three", Name: "Three"}})
+	})
+
+	counts := map[EventType]int{}
+
+	for _, ev := range events {
+		counts[ev.Type]++
+	}
+
+	if counts[EventSpeakerRemoved] != 2 || counts[EventSpeakerAdded] != 1 || counts[EventSpeakerRenamed] != 0 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	if _, ok := a.volumes["AA11BB22CC33@Three"]; ok {
+		t.Fatal("a volume moved to Three")
+	}
+
+	//a second speaker on the same hardware next to one still listed is just added
+	events = listEvents(t, a, func() {
+		a.applySpeakerList([]Speaker{
+			{LongIdentifier: "AA11BB22CC33@Three", Name: "Three"},
+			{LongIdentifier: "AA11BB22CC33@Four", Name: "Four"},
+		})
+	})
+
+	if len(events) != 1 || events[0].Type != EventSpeakerAdded || events[0].Speaker != "AA11BB22CC33@Four" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+}
@@ -0,0 +1,275 @@
+package airfoilgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how long to wait for more changes before writing the state out
+var storeDelay = 2 * time.Second
+
+// StoredState is what survives a restart
+type StoredState struct {
+	Speakers     map[string]Speaker `json:"speakers"`
+	Sources      map[string]Source  `json:"sources"`
+	ActiveSource string             `json:"activeSource"`
+	Nicknames    map[string]string  `json:"nicknames"`
+	Volumes      map[string]float64 `json:"volumes"`
+	Saved        time.Time          `json:"saved"`
+}
+
+// Store persists the last known state, FileStore is the default
+type Store interface {
+	Load() (*StoredState, error)
+	Save(*StoredState) error
+}
+
+type FileStore struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// Load returns an empty state if nothing has been saved yet
+func (f *FileStore) Load() (*StoredState, error) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	st := &StoredState{}
+
+	b, err := ioutil.ReadFile(f.Path)
+
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+
+	if err != nil {
+		return st, err
+	}
+
+	err = json.Unmarshal(b, st)
+
+	return st, err
+
+}
+
+// Save writes to a temp file first so a crash never leaves a half written state behind
+func (f *FileStore) Save(st *StoredState) error {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	b, err := json.MarshalIndent(st, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	_, werr := tmp.Write(b)
+	cerr := tmp.Close()
+
+	if werr != nil || cerr != nil {
+
+		os.Remove(tmp.Name())
+
+		if werr != nil {
+			return werr
+		}
+
+		return cerr
+	}
+
+	return os.Rename(tmp.Name(), f.Path)
+
+}
+
+// SetStore loads the last known state from s, flagged as stale until airfoil sends fresh data,
+// and saves to it from then on
+func (a *AirfoilConn) SetStore(s Store) error {
+
+	st, err := s.Load()
+
+	if err != nil {
+		return err
+	}
+
+	a.speakerLock.Lock()
+
+	for id, spk := range st.Speakers {
+
+		//never overwrite something airfoil already told us
+		if _, ok := a.speakers[id]; !ok {
+			spk.Stale = true
+			a.speakers[id] = spk
+		}
+
+	}
+
+	for id, nick := range st.Nicknames {
+		a.nicknames[id] = nick
+	}
+
+	for id, vol := range st.Volumes {
+		a.volumes[id] = vol
+	}
+
+	a.speakerLock.Unlock()
+
+	a.sourceLock.Lock()
+
+	//a catalog from airfoil wins, the stored one is only a stand in until the first getSourceList
+	if len(a.catalog.Categories) == 0 {
+
+		list := make([]Source, 0, len(st.Sources))
+
+		for id, src := range st.Sources {
+			src.Stale = true
+			a.sources[id] = src
+			list = append(list, src)
+		}
+
+		a.catalog = catalogFromSources(list)
+
+	}
+
+	a.sourceLock.Unlock()
+
+	a.bump()
+
+	if a.ActiveSource().Identifier == "" && st.ActiveSource != "" {
+
+		src, serr := a.GetSource(st.ActiveSource)
+
+		if serr == nil {
+			a.setActiveSource(*src, ChangedByStore)
+		}
+
+	}
+
+	a.storeLock.Lock()
+	a.store = s
+	a.storeLock.Unlock()
+
+	return nil
+
+}
+
+// SetNickname gives a speaker a name of our own, an empty name removes it
+func (a *AirfoilConn) SetNickname(id string, nick string) {
+
+	a.speakerLock.Lock()
+
+	if nick == "" {
+		delete(a.nicknames, id)
+	} else {
+		a.nicknames[id] = nick
+	}
+
+	a.speakerLock.Unlock()
+
+	a.persist()
+
+}
+
+func (a *AirfoilConn) Nickname(id string) string {
+
+	a.speakerLock.RLock()
+	defer a.speakerLock.RUnlock()
+
+	return a.nicknames[id]
+
+}
+
+// RememberedVolume is the last non zero volume seen for the speaker, even across restarts
+func (a *AirfoilConn) RememberedVolume(id string) (float64, bool) {
+
+	a.speakerLock.RLock()
+	defer a.speakerLock.RUnlock()
+
+	vol, ok := a.volumes[id]
+
+	return vol, ok
+
+}
+
+// persist schedules a save, bursts of changes end up in a single write
+func (a *AirfoilConn) persist() {
+
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+
+	if a.store == nil || a.storePending {
+		return
+	}
+
+	a.storePending = true
+
+	time.AfterFunc(storeDelay, func() {
+
+		a.storeLock.Lock()
+		a.storePending = false
+		s := a.store
+		a.storeLock.Unlock()
+
+		if err := s.Save(a.storedState()); err != nil {
+			a.logf("State Save Error: %s\n", err)
+		}
+
+	})
+
+}
+
+func (a *AirfoilConn) storedState() *StoredState {
+
+	st := &StoredState{
+		Speakers:     make(map[string]Speaker),
+		Sources:      make(map[string]Source),
+		ActiveSource: a.ActiveSource().Identifier,
+		Nicknames:    make(map[string]string),
+		Volumes:      make(map[string]float64),
+		Saved:        time.Now(),
+	}
+
+	a.speakerLock.RLock()
+
+	for id, spk := range a.speakers {
+		spk.Stale = false
+		st.Speakers[id] = spk
+	}
+
+	for id, nick := range a.nicknames {
+		st.Nicknames[id] = nick
+	}
+
+	for id, vol := range a.volumes {
+		st.Volumes[id] = vol
+	}
+
+	a.speakerLock.RUnlock()
+
+	a.sourceLock.RLock()
+
+	for id, src := range a.sources {
+		src.Stale = false
+		st.Sources[id] = src
+	}
+
+	a.sourceLock.RUnlock()
+
+	return st
+
+}
@@ -0,0 +1,198 @@
+package airfoilgo
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts the saves that reach the file
+type countingStore struct {
+	*FileStore
+	lock  sync.Mutex
+	saves int
+}
+
+func (c *countingStore) Save(st *StoredState) error {
+
+	c.lock.Lock()
+	c.saves++
+	c.lock.Unlock()
+
+	return c.FileStore.Save(st)
+
+}
+
+func (c *countingStore) count() int {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.saves
+
+}
+
+func storedFixture() *StoredState {
+
+	return &StoredState{
+		Speakers:     map[string]Speaker{"DC9B9CEFC55C@Kitchen": {LongIdentifier: "DC9B9CEFC55C@Kitchen", Name: "Kitchen", Volume: 0.4}},
+		Sources:      map[string]Source{"com.spotify.client": {Identifier: "com.spotify.client", FriendlyName: "Spotify", Type: SourceTypeRunningApplications}},
+		ActiveSource: "com.spotify.client",
+		Nicknames:    map[string]string{"DC9B9CEFC55C@Kitchen": "cooking"},
+		Volumes:      map[string]float64{"DC9B9CEFC55C@Kitchen": 0.4},
+		Saved:        time.Now().Round(0),
+	}
+
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+
+	dir := t.TempDir()
+	fs := NewFileStore(filepath.Join(dir, "state.json"))
+
+	st, err := fs.Load()
+
+	if err != nil || len(st.Speakers) != 0 {
+		t.Fatalf("nothing saved yet gave %+v, %v", st, err)
+	}
+
+	want := storedFixture()
+
+	if err := fs.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	want.Nicknames["DC9B9CEFC55C@Kitchen"] = "chef"
+
+	//the second save replaces the file
+	if err := fs.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := fs.Load()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Speakers["DC9B9CEFC55C@Kitchen"] != want.Speakers["DC9B9CEFC55C@Kitchen"] || got.Sources["com.spotify.client"] != want.Sources["com.spotify.client"] {
+		t.Fatalf("loaded %+v", got)
+	}
+
+	if got.ActiveSource != want.ActiveSource || got.Nicknames["DC9B9CEFC55C@Kitchen"] != "chef" || got.Volumes["DC9B9CEFC55C@Kitchen"] != 0.4 || !got.Saved.Equal(want.Saved) {
+		t.Fatalf("loaded %+v", got)
+	}
+
+	//the temp file was renamed over the state, nothing is left behind
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		t.Fatalf("left in the directory: %v", entries)
+	}
+
+	if err := os.WriteFile(fs.Path, []byte("{half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Load(); err == nil {
+		t.Fatal("a broken file loaded")
+	}
+
+}
+
+func TestSetStoreLoadsStale(t *testing.T) {
+
+	fs := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+
+	if err := fs.Save(storedFixture()); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewConn("pipe", WithLogger(log.New(io.Discard, "", 0)))
+
+	if err := a.SetStore(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	spk, err := a.GetSpeaker("DC9B9CEFC55C@Kitchen")
+
+	if err != nil || !spk.Stale || spk.Name != "Kitchen" {
+		t.Fatalf("stored speaker %+v, %v", spk, err)
+	}
+
+	src, err := a.GetSource("com.spotify.client")
+
+	if err != nil || !src.Stale {
+		t.Fatalf("stored source %+v, %v", src, err)
+	}
+
+	if change := a.ActiveSourceChange(); change.Source.Identifier != "com.spotify.client" || change.ChangedBy != ChangedByStore {
+		t.Fatalf("active source %+v", change)
+	}
+
+	if a.Nickname("DC9B9CEFC55C@Kitchen") != "cooking" {
+		t.Fatal("the nickname wasn't loaded")
+	}
+
+	if vol, ok := a.RememberedVolume("DC9B9CEFC55C@Kitchen"); !ok || vol != 0.4 {
+		t.Fatalf("remembered volume %v, %v", vol, ok)
+	}
+
+	//stale is how it was loaded, not something to save
+	if st := a.storedState(); st.Speakers["DC9B9CEFC55C@Kitchen"].Stale || st.Sources["com.spotify.client"].Stale {
+		t.Fatalf("saving %+v", st)
+	}
+
+}
+
+func TestPersistDebounce(t *testing.T) {
+
+	prev := storeDelay
+	storeDelay = 50 * time.Millisecond
+
+	defer func() {
+		storeDelay = prev
+	}()
+
+	cs := &countingStore{FileStore: NewFileStore(filepath.Join(t.TempDir(), "state.json"))}
+
+	a := NewConn("pipe", WithLogger(log.New(io.Discard, "", 0)))
+
+	if err := a.SetStore(cs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nick := range []string{"a", "b", "c", "d", "e"} {
+		a.SetNickname("DC9B9CEFC55C@Kitchen", nick)
+	}
+
+	time.Sleep(4 * storeDelay)
+
+	if n := cs.count(); n != 1 {
+		t.Fatalf("a burst of changes was saved %d times", n)
+	}
+
+	st, err := cs.Load()
+
+	if err != nil || st.Nicknames["DC9B9CEFC55C@Kitchen"] != "e" {
+		t.Fatalf("saved %+v, %v", st, err)
+	}
+
+	//a change after the write is saved again
+	a.SetNickname("DC9B9CEFC55C@Kitchen", "")
+
+	time.Sleep(4 * storeDelay)
+
+	if n := cs.count(); n != 2 {
+		t.Fatalf("saved %d times", n)
+	}
+
+}
@@ -0,0 +1,187 @@
+package airfoilgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNoConnectedSpeakers = errors.New("NO_CONNECTED_SPEAKERS")
+
+// how often Fade sends the next volume
+const fadeStep = 100 * time.Millisecond
+
+// MasterVolume is the "house volume", the level of the loudest connected speaker
+func (a *AirfoilConn) MasterVolume() float64 {
+
+	a.speakerLock.RLock()
+	defer a.speakerLock.RUnlock()
+
+	return masterVolume(a.speakers)
+
+}
+
+// SetMasterVolume scales every connected speaker so the loudest one ends up at vol,
+// the others keep their volume relative to it
+func (a *AirfoilConn) SetMasterVolume(vol float64) error {
+
+	vol = clampVolume(vol)
+
+	a.speakerLock.RLock()
+	targets := masterTargets(a.speakers, a.volumes, vol)
+	a.speakerLock.RUnlock()
+
+	if len(targets) < 1 {
+		return ErrNoConnectedSpeakers
+	}
+
+	var failed []string
+
+	for id, v := range targets {
+
+		if err := a.Volume(id, v); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", id, err))
+		}
+
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("master volume not applied to %d speaker(s): %v", len(failed), failed)
+	}
+
+	return nil
+
+}
+
+// AdjustMasterVolume moves the master volume up or down by delta (-1 to 1)
+func (a *AirfoilConn) AdjustMasterVolume(delta float64) error {
+
+	return a.SetMasterVolume(a.MasterVolume() + delta)
+
+}
+
+// Fade moves a speaker from its current volume to vol in even steps over d and returns after the last
+// one was sent. It stops where it is when ctx is done
+func (a *AirfoilConn) Fade(ctx context.Context, id string, vol float64, d time.Duration) error {
+
+	spk, err := a.GetSpeaker(id)
+
+	if err != nil {
+		return err
+	}
+
+	from, vol := spk.Volume, clampVolume(vol)
+
+	steps := int(d / fadeStep)
+
+	if steps < 1 {
+		return a.Volume(id, vol)
+	}
+
+	tick := time.NewTicker(d / time.Duration(steps))
+	defer tick.Stop()
+
+	for i := 1; i <= steps; i++ {
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+
+		if err := a.Volume(id, from+(vol-from)*float64(i)/float64(steps)); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// masterTargets is the volume each connected speaker gets for master volume vol. With every speaker
+// at 0 the live volumes have no balance left, so it comes from the last non zero volume remembered
+func masterTargets(spks map[string]Speaker, remembered map[string]float64, vol float64) map[string]float64 {
+
+	base := make(map[string]float64)
+
+	for id, s := range spks {
+
+		if s.Connected {
+			base[id] = s.Volume
+		}
+
+	}
+
+	current := masterVolume(spks)
+
+	if current == 0 {
+
+		for id := range base {
+
+			if v, ok := remembered[id]; ok && v > current {
+				current = v
+			}
+
+		}
+
+		//a speaker with nothing remembered comes up with the loudest
+		for id := range base {
+
+			if v, ok := remembered[id]; ok && v > 0 {
+				base[id] = v
+			} else {
+				base[id] = current
+			}
+
+		}
+
+	}
+
+	targets := make(map[string]float64)
+
+	for id, b := range base {
+
+		if current > 0 {
+			targets[id] = clampVolume(b * vol / current)
+		} else {
+			//nothing to keep in balance, bring them all up together
+			targets[id] = vol
+		}
+
+	}
+
+	return targets
+
+}
+
+func masterVolume(spks map[string]Speaker) float64 {
+
+	var max float64
+
+	for _, s := range spks {
+
+		if s.Connected && s.Volume > max {
+			max = s.Volume
+		}
+
+	}
+
+	return max
+
+}
+
+func clampVolume(vol float64) float64 {
+
+	if vol < 0 {
+		return 0
+	}
+
+	if vol > 1 {
+		return 1
+	}
+
+	return vol
+
+}
@@ -0,0 +1,137 @@
+package airfoilgo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVolumeZeroIsSent(t *testing.T) {
+
+	a, _, sent := pipeConn(t)
+
+	if err := a.Volume("AA@Kitchen", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	data := nextRequest(t, sent)["data"].(map[string]interface{})
+
+	if v, ok := data["volume"]; !ok || v != 0.0 {
+		t.Fatalf("volume not sent as 0: %v", data)
+	}
+
+}
+
+func TestMasterTargets(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		speakers   map[string]Speaker
+		remembered map[string]float64
+		vol        float64
+		want       map[string]float64
+	}{
+		{
+			name:     "keeps the balance",
+			speakers: map[string]Speaker{"a": {Connected: true, Volume: 0.8}, "b": {Connected: true, Volume: 0.4}},
+			vol:      0.5,
+			want:     map[string]float64{"a": 0.5, "b": 0.25},
+		},
+		{
+			name:     "leaves disconnected speakers alone",
+			speakers: map[string]Speaker{"a": {Connected: true, Volume: 0.5}, "b": {Volume: 0.9}},
+			vol:      1,
+			want:     map[string]float64{"a": 1},
+		},
+		{
+			name:     "down to silence",
+			speakers: map[string]Speaker{"a": {Connected: true, Volume: 0.8}, "b": {Connected: true, Volume: 0.4}},
+			vol:      0,
+			want:     map[string]float64{"a": 0, "b": 0},
+		},
+		{
+			name:       "back up from silence with the remembered balance",
+			speakers:   map[string]Speaker{"a": {Connected: true}, "b": {Connected: true}},
+			remembered: map[string]float64{"a": 0.8, "b": 0.4},
+			vol:        0.4,
+			want:       map[string]float64{"a": 0.4, "b": 0.2},
+		},
+		{
+			name:       "nothing remembered comes up with the loudest",
+			speakers:   map[string]Speaker{"a": {Connected: true}, "b": {Connected: true}},
+			remembered: map[string]float64{"a": 0.5},
+			vol:        0.6,
+			want:       map[string]float64{"a": 0.6, "b": 0.6},
+		},
+		{
+			name:     "nothing to balance at all",
+			speakers: map[string]Speaker{"a": {Connected: true}, "b": {Connected: true}},
+			vol:      0.3,
+			want:     map[string]float64{"a": 0.3, "b": 0.3},
+		},
+	}
+
+	for _, tt := range tests {
+
+		t.Run(tt.name, func(t *testing.T) {
+
+			got := masterTargets(tt.speakers, tt.remembered, tt.vol)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			for id, v := range tt.want {
+
+				if math.Abs(got[id]-v) > 1e-9 {
+					t.Fatalf("%s got %v, want %v", id, got[id], v)
+				}
+
+			}
+
+		})
+
+	}
+
+}
+
+func TestSetMasterVolumeBalance(t *testing.T) {
+
+	a, _, sent := pipeConn(t)
+
+	a.SetSpeaker(&Speaker{LongIdentifier: "a", Connected: true, Volume: 0.8})
+	a.SetSpeaker(&Speaker{LongIdentifier: "b", Connected: true, Volume: 0.4})
+
+	sentVolumes := func(n int) map[string]float64 {
+
+		out := make(map[string]float64)
+
+		for i := 0; i < n; i++ {
+			data := nextRequest(t, sent)["data"].(map[string]interface{})
+			out[data["longIdentifier"].(string)] = data["volume"].(float64)
+		}
+
+		return out
+
+	}
+
+	if err := a.SetMasterVolume(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sentVolumes(2); got["a"] != 0 || got["b"] != 0 {
+		t.Fatalf("master 0 sent %v", got)
+	}
+
+	//airfoil confirms, the live volumes are all 0 now
+	a.SetSpeaker(&Speaker{LongIdentifier: "a", Connected: true})
+	a.SetSpeaker(&Speaker{LongIdentifier: "b", Connected: true})
+
+	if err := a.SetMasterVolume(0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sentVolumes(2); got["a"] != 0.5 || got["b"] != 0.25 {
+		t.Fatalf("balance lost, sent %v", got)
+	}
+
+}
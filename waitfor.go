@@ -0,0 +1,197 @@
+package airfoilgo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TimeoutError is returned by the WaitFor helpers when no notification confirmed the change in time,
+// errors.Is(err, context.DeadlineExceeded) still works through Unwrap
+type TimeoutError struct {
+	Op  string
+	ID  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s not confirmed: %s", e.Op, e.ID, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// watchRecheck is how often a watcher checks again without an event, a state change that reached the
+// cache without one still counts
+const watchRecheck = 250 * time.Millisecond
+
+// watcher re-runs check after every event, and every watchRecheck, until it holds
+type watcher struct {
+	changed chan struct{}
+	cancel  func()
+	check   func() bool
+}
+
+// watch starts listening right away, before the command goes out, so the confirmation can't slip past
+func (a *AirfoilConn) watch(check func() bool) *watcher {
+
+	w := &watcher{changed: make(chan struct{}, 1), check: check}
+
+	w.cancel = a.Listen(func(ev Event) {
+
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+
+	})
+
+	return w
+
+}
+
+func (w *watcher) wait(ctx context.Context, op string, id string) error {
+
+	defer w.cancel()
+
+	tick := time.NewTicker(watchRecheck)
+	defer tick.Stop()
+
+	for {
+
+		if w.check() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return &TimeoutError{Op: op, ID: id, Err: ctx.Err()}
+		case <-w.changed:
+		case <-tick.C:
+		}
+
+	}
+
+}
+
+// WaitForSpeaker returns the speaker once pred holds for it, checked now and after every change
+func (a *AirfoilConn) WaitForSpeaker(ctx context.Context, id string, pred func(Speaker) bool) (Speaker, error) {
+
+	var found Speaker
+
+	w := a.watch(func() bool {
+
+		spk, err := a.GetSpeaker(id)
+
+		if err != nil {
+			return false
+		}
+
+		found = *spk
+
+		return pred(found)
+
+	})
+
+	err := w.wait(ctx, "wait for speaker", id)
+
+	return found, err
+
+}
+
+func (a *AirfoilConn) ConnectAndWait(ctx context.Context, id string) error {
+
+	w := a.watch(a.speakerCheck(id, func(spk Speaker) bool {
+		return spk.Connected
+	}))
+
+	if err := a.Connect(id); err != nil {
+		w.cancel()
+		return err
+	}
+
+	return w.wait(ctx, "connect", id)
+
+}
+
+func (a *AirfoilConn) DisconnectAndWait(ctx context.Context, id string) error {
+
+	w := a.watch(a.speakerCheck(id, func(spk Speaker) bool {
+		return !spk.Connected
+	}))
+
+	if err := a.Disconnect(id); err != nil {
+		w.cancel()
+		return err
+	}
+
+	return w.wait(ctx, "disconnect", id)
+
+}
+
+// VolumeAndWait counts the volume as confirmed within half a percent, airfoil rounds what it reports back
+func (a *AirfoilConn) VolumeAndWait(ctx context.Context, id string, vol float64) error {
+
+	w := a.watch(a.speakerCheck(id, func(spk Speaker) bool {
+		return math.Abs(spk.Volume-vol) < 0.005
+	}))
+
+	if err := a.Volume(id, vol); err != nil {
+		w.cancel()
+		return err
+	}
+
+	return w.wait(ctx, "volume", id)
+
+}
+
+// FadeAndWait fades like Fade, then waits for airfoil to report the final volume, ctx covers both
+func (a *AirfoilConn) FadeAndWait(ctx context.Context, id string, vol float64, d time.Duration) error {
+
+	vol = clampVolume(vol)
+
+	w := a.watch(a.speakerCheck(id, func(spk Speaker) bool {
+		return math.Abs(spk.Volume-vol) < 0.005
+	}))
+
+	if err := a.Fade(ctx, id, vol, d); err != nil {
+		w.cancel()
+		return err
+	}
+
+	return w.wait(ctx, "fade", id)
+
+}
+
+// SetSourceAndWait returns once the metadata names ident as the active source
+func (a *AirfoilConn) SetSourceAndWait(ctx context.Context, ident string) error {
+
+	w := a.watch(func() bool {
+		return a.ActiveSource().Identifier == ident
+	})
+
+	if err := a.SetSource(ident); err != nil {
+		w.cancel()
+		return err
+	}
+
+	//don't rely on airfoil announcing the metadata change
+	a.FetchMetadata()
+
+	return w.wait(ctx, "select source", ident)
+
+}
+
+func (a *AirfoilConn) speakerCheck(id string, pred func(Speaker) bool) func() bool {
+
+	return func() bool {
+
+		spk, err := a.GetSpeaker(id)
+
+		return err == nil && pred(*spk)
+
+	}
+
+}
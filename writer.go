@@ -0,0 +1,248 @@
+package airfoilgo
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Priority orders the outbound queue, user commands go out ahead of background polls
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+var ErrNotReady = errors.New("Connection Status Not Ready")
+var ErrQueueFull = errors.New("QUEUE_FULL")
+var ErrConnClosed = errors.New("CONNECTION_CLOSED")
+
+type outbound struct {
+	payload  []byte
+	priority Priority
+	key      string //identical pending payloads with a key are only sent once
+	done     chan error
+}
+
+// writeQueue feeds the single writer goroutine of a connection
+type writeQueue struct {
+	lock   sync.Mutex
+	items  [PriorityHigh + 1][]*outbound
+	size   int
+	max    int
+	err    error
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+func newWriteQueue(max int) *writeQueue {
+
+	return &writeQueue{
+		max:    max,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+}
+
+// push returns false when an identical request was already waiting
+func (q *writeQueue) push(item *outbound) (bool, error) {
+
+	q.lock.Lock()
+
+	if q.err != nil {
+		q.lock.Unlock()
+		return false, q.err
+	}
+
+	if item.key != "" {
+
+		for _, it := range q.items[item.priority] {
+
+			if it.key == item.key {
+				q.lock.Unlock()
+				return false, nil
+			}
+
+		}
+
+	}
+
+	if q.size >= q.max {
+		q.lock.Unlock()
+		return false, ErrQueueFull
+	}
+
+	q.items[item.priority] = append(q.items[item.priority], item)
+	q.size++
+
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return true, nil
+
+}
+
+// next blocks until there is something to write, false once the queue is closed
+func (q *writeQueue) next() (*outbound, bool) {
+
+	for {
+
+		q.lock.Lock()
+
+		for p := PriorityHigh; p >= PriorityLow; p-- {
+
+			if len(q.items[p]) > 0 {
+
+				item := q.items[p][0]
+				q.items[p] = q.items[p][1:]
+				q.size--
+
+				q.lock.Unlock()
+				return item, true
+
+			}
+
+		}
+
+		q.lock.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-q.closed:
+			return nil, false
+		}
+
+	}
+
+}
+
+func (q *writeQueue) depth() int {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.size
+
+}
+
+// close fails everything still waiting with err
+func (q *writeQueue) close(err error) {
+
+	q.lock.Lock()
+
+	if q.err != nil {
+		q.lock.Unlock()
+		return
+	}
+
+	q.err = err
+	close(q.closed)
+
+	var waiting []*outbound
+
+	for p := range q.items {
+		waiting = append(waiting, q.items[p]...)
+		q.items[p] = nil
+	}
+
+	q.size = 0
+
+	q.lock.Unlock()
+
+	for _, it := range waiting {
+		it.done <- err
+	}
+
+}
+
+// writeLoop is the only thing writing to conn
+func (a *AirfoilConn) writeLoop(conn net.Conn, q *writeQueue) {
+
+	for {
+
+		item, ok := q.next()
+
+		if !ok {
+			return
+		}
+
+		a.metrics.Set("write_queue_depth", float64(q.depth()))
+
+		if a.WriteTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(a.WriteTimeout))
+		}
+
+		_, err := conn.Write(item.payload)
+
+		item.done <- err
+
+		if err != nil {
+
+			//a partial write leaves the stream unframed, drop the connection and let KeepAlive redial
+			a.logf("Write Error: %s\n", err)
+			a.metrics.Add("write_errors_total", 1)
+			a.addError(err)
+			a.connLost(q)
+			q.close(err)
+			conn.Close()
+			return
+
+		}
+
+		a.metrics.Add("writes_total", 1)
+
+	}
+
+}
+
+// enqueue hands payload to the writer and waits for it to hit the socket
+func (a *AirfoilConn) enqueue(payload string, p Priority, key string) error {
+
+	a.connLock.Lock()
+	q := a.queue
+	a.connLock.Unlock()
+
+	if q == nil {
+		return ErrConnClosed
+	}
+
+	item := &outbound{payload: []byte(payload), priority: p, key: key, done: make(chan error, 1)}
+
+	queued, err := q.push(item)
+
+	if err != nil {
+		a.metrics.Add("write_queue_rejected_total", 1)
+		return err
+	}
+
+	if !queued {
+		a.metrics.Add("write_coalesced_total", 1)
+		return nil
+	}
+
+	a.metrics.Set("write_queue_depth", float64(q.depth()))
+
+	return <-item.done
+
+}
+
+func (a *AirfoilConn) addError(err error) {
+
+	a.errLock.Lock()
+	defer a.errLock.Unlock()
+
+	a.Errors = append(a.Errors, err)
+
+	if len(a.Errors) > maxErrors {
+		a.Errors = a.Errors[len(a.Errors)-maxErrors:]
+	}
+
+}
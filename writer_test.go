@@ -0,0 +1,121 @@
+package airfoilgo
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZeroWriteTimeout(t *testing.T) {
+
+	a, _, sent := pipeConn(t, WithWriteTimeout(0))
+
+	for i := 0; i < 3; i++ {
+
+		if err := a.Volume("AA@Kitchen", 0.5); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+
+		if req := nextRequest(t, sent); req["request"] != "setSpeakerVolume" {
+			t.Fatalf("unexpected request %v", req)
+		}
+
+	}
+
+}
+
+func TestWriteQueueOrder(t *testing.T) {
+
+	a, remote := dialPipe(t)
+
+	a.connLock.Lock()
+	q := a.queue
+	a.connLock.Unlock()
+
+	waitDepth := func(n int) {
+
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second)
+
+		for q.depth() != n {
+
+			if time.Now().After(deadline) {
+				t.Fatalf("queue depth %d, want %d", q.depth(), n)
+			}
+
+			time.Sleep(time.Millisecond)
+
+		}
+
+	}
+
+	errs := make(chan error, 8)
+
+	push := func(payload string, p Priority, key string, depth int) {
+		go func() { errs <- a.enqueue(payload+"\n", p, key) }()
+		waitDepth(depth)
+	}
+
+	//one byte read, the writer holds the rest of the first frame until the others are queued
+	go func() { errs <- a.enqueue("first\n", PriorityNormal, "") }()
+
+	if _, err := remote.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	push("poll", PriorityLow, "", 1)
+	push("kitchen 0.2", PriorityNormal, "volume:kitchen", 2)
+
+	//the same key while the first is still waiting is only sent once
+	if err := a.enqueue("kitchen 0.2\n", PriorityNormal, "volume:kitchen"); err != nil {
+		t.Fatal(err)
+	}
+
+	push("hello", PriorityHigh, "", 3)
+	push("office 0.4", PriorityNormal, "volume:office", 4)
+
+	var got []string
+
+	r := bufio.NewReader(remote)
+
+	for i := 0; i < 5; i++ {
+
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, strings.TrimSuffix(line, "\n"))
+
+	}
+
+	want := []string{"irst", "hello", "kitchen 0.2", "office 0.4", "poll"}
+
+	for i := range want {
+
+		if got[i] != want[i] {
+			t.Fatalf("written %q, want %q", got, want)
+		}
+
+	}
+
+	for i := 0; i < 5; i++ {
+
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	if n := a.Metrics()["write_coalesced_total"]; n != 1 {
+		t.Fatalf("write_coalesced_total is %v, want 1", n)
+	}
+
+	if q.depth() != 0 {
+		t.Fatalf("%d frames left", q.depth())
+	}
+
+}